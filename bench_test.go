@@ -13,6 +13,7 @@ func BenchmarkLookupReference(b *testing.B) {
 	if err != nil {
 		b.Fatal(err)
 	}
+	defer repos.Close()
 
 	cases := [...]struct {
 		name  string
@@ -44,6 +45,8 @@ func BenchmarkOpenRepository(b *testing.B) {
 		if err != nil {
 			b.Fatal(err)
 		}
+		// The idx and pack files stay mapped until Close
+		sinkrepo.Close()
 	}
 }
 
@@ -53,6 +56,7 @@ func BenchmarkLookupBlob(b *testing.B) {
 	if err != nil {
 		b.Fatal(err)
 	}
+	defer repos.Close()
 	b.ResetTimer()
 
 	for i := 0; i < b.N; i++ {
@@ -62,3 +66,50 @@ func BenchmarkLookupBlob(b *testing.B) {
 		}
 	}
 }
+
+// file.txt in the HEAD commit of deltachain.git is at the end of a delta
+// chain of length 48.
+func BenchmarkDeltaChain(b *testing.B) {
+	cases := [...]struct {
+		name  string
+		limit int64
+	}{
+		{name: "nocache", limit: -1},
+		{name: "cache", limit: 0},
+	}
+
+	for _, bench := range cases {
+		b.Run(bench.name, func(b *testing.B) {
+			repos, err := OpenRepositoryWithOptions("_testdata/deltachain.git", &RepositoryOptions{DeltaBaseCacheLimit: bench.limit})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer repos.Close()
+			oid := mustOidFromString(b, "df17b922100f2ddf3301c869a92d9921a117fe92")
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				sinkblob, err = repos.LookupBlob(oid)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkWalk(b *testing.B) {
+	repos, err := OpenRepository("_testdata/testrepo.git")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer repos.Close()
+	ci, err := repos.LookupCommit(mustOidFromString(b, "7647bdef73cde0888222b7ea00f5e83b151a25d0"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		ci.Tree.Walk(func(string, *TreeEntry) int { return 0 })
+	}
+}
@@ -20,6 +20,11 @@
 
 package gogit
 
+import (
+	"fmt"
+	"io"
+)
+
 type Blob struct {
 	data []byte
 }
@@ -35,6 +40,23 @@ func (repos *Repository) LookupBlob(oid *Oid) (*Blob, error) {
 	return b, nil
 }
 
+// Return a reader for the contents of the blob and its size. Unlike
+// LookupBlob, the contents are not read into memory at once, so this is
+// the way to access large files. If the blob is stored deltified in a pack
+// file, the base object is kept in memory while reading. The caller must
+// close the reader.
+func (repos *Repository) BlobReader(oid *Oid) (io.ReadCloser, int64, error) {
+	ot, length, rc, err := repos.getObjectReader(oid)
+	if err != nil {
+		return nil, 0, err
+	}
+	if ot != ObjectBlob {
+		rc.Close()
+		return nil, 0, fmt.Errorf("object %s is not a blob", oid)
+	}
+	return rc, length, nil
+}
+
 func (b *Blob) Size() int {
 	return len(b.data)
 }
@@ -0,0 +1,190 @@
+// Copyright (c) 2013 Patrick Gundlach, speedata (Berlin, Germany)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gogit
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Default memory limit of the delta base cache, same as git's
+// core.deltaBaseCacheLimit.
+const defaultDeltaBaseCacheLimit = 96 << 20
+
+type deltaBaseKey struct {
+	packpath string
+	offset   uint64
+}
+
+type deltaBaseEntry struct {
+	key  deltaBaseKey
+	ot   ObjectType
+	data []byte
+}
+
+// The deltaBaseCache holds the inflated contents of objects that served
+// as delta bases, so walking along a delta chain doesn't have to inflate
+// every base again. The least recently used objects are evicted once the
+// total size of the cached objects exceeds limit. A nil *deltaBaseCache
+// is a valid, always empty cache.
+type deltaBaseCache struct {
+	mu      sync.Mutex
+	limit   int64
+	size    int64
+	lru     *list.List // front is the most recently used entry
+	entries map[deltaBaseKey]*list.Element
+}
+
+func newDeltaBaseCache(limit int64) *deltaBaseCache {
+	return &deltaBaseCache{
+		limit:   limit,
+		lru:     list.New(),
+		entries: make(map[deltaBaseKey]*list.Element),
+	}
+}
+
+// Return the cached object at offset in the pack file packpath. The
+// returned data must not be modified.
+func (c *deltaBaseCache) get(packpath string, offset uint64) (ObjectType, []byte, bool) {
+	if c == nil {
+		return 0, nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elt, ok := c.entries[deltaBaseKey{packpath, offset}]
+	if !ok {
+		return 0, nil, false
+	}
+	c.lru.MoveToFront(elt)
+	entry := elt.Value.(*deltaBaseEntry)
+	return entry.ot, entry.data, true
+}
+
+// Add the object at offset in the pack file packpath to the cache. Objects
+// larger than the limit of the cache are not stored.
+func (c *deltaBaseCache) add(packpath string, offset uint64, ot ObjectType, data []byte) {
+	if c == nil || int64(len(data)) > c.limit {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := deltaBaseKey{packpath, offset}
+	if elt, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(elt)
+		return
+	}
+	if c.entries == nil {
+		// closed
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&deltaBaseEntry{key: key, ot: ot, data: data})
+	c.size += int64(len(data))
+	for c.size > c.limit {
+		elt := c.lru.Back()
+		entry := elt.Value.(*deltaBaseEntry)
+		c.lru.Remove(elt)
+		delete(c.entries, entry.key)
+		c.size -= int64(len(entry.data))
+	}
+}
+
+// Drop all objects and don't accept new ones.
+func (c *deltaBaseCache) close() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Init()
+	c.entries = nil
+	c.size = 0
+}
+
+type objectCacheEntry struct {
+	key string
+	obj interface{}
+}
+
+// The objectCache holds parsed objects (commits and trees) by their id.
+// It is bounded by the number of objects, the least recently used object
+// is evicted first. A nil *objectCache is a valid, always empty cache.
+type objectCache struct {
+	mu      sync.Mutex
+	size    int
+	lru     *list.List // front is the most recently used entry
+	entries map[string]*list.Element
+}
+
+func newObjectCache(size int) *objectCache {
+	return &objectCache{
+		size:    size,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Return the cached object with the given id or nil.
+func (c *objectCache) get(oid *Oid) interface{} {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elt, ok := c.entries[oid.key()]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(elt)
+	return elt.Value.(*objectCacheEntry).obj
+}
+
+func (c *objectCache) add(oid *Oid, obj interface{}) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elt, ok := c.entries[oid.key()]; ok {
+		c.lru.MoveToFront(elt)
+		return
+	}
+	if c.entries == nil {
+		// closed
+		return
+	}
+	c.entries[oid.key()] = c.lru.PushFront(&objectCacheEntry{key: oid.key(), obj: obj})
+	for c.lru.Len() > c.size {
+		elt := c.lru.Back()
+		c.lru.Remove(elt)
+		delete(c.entries, elt.Value.(*objectCacheEntry).key)
+	}
+}
+
+// Drop all objects and don't accept new ones.
+func (c *objectCache) close() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Init()
+	c.entries = nil
+}
@@ -0,0 +1,98 @@
+package gogit
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDeltaBaseCache(t *testing.T) {
+	c := newDeltaBaseCache(10)
+	c.add("a.pack", 12, ObjectBlob, []byte("1234"))
+	c.add("a.pack", 20, ObjectBlob, []byte("5678"))
+	// too large, not stored
+	c.add("a.pack", 30, ObjectBlob, []byte("12345678901"))
+	if _, _, ok := c.get("a.pack", 30); ok {
+		t.Error("object larger than the cache limit should not be cached")
+	}
+	// make 12 the most recently used entry, so 20 is evicted next
+	if _, data, ok := c.get("a.pack", 12); !ok || !bytes.Equal(data, []byte("1234")) {
+		t.Error("object at offset 12 should be cached")
+	}
+	c.add("b.pack", 12, ObjectTree, []byte("abcd"))
+	if _, _, ok := c.get("a.pack", 20); ok {
+		t.Error("object at offset 20 should have been evicted")
+	}
+	if ot, _, ok := c.get("b.pack", 12); !ok || ot != ObjectTree {
+		t.Error("object in b.pack should be cached")
+	}
+	if c.size != 8 {
+		t.Error("cache size should be 8, got", c.size)
+	}
+
+	var nilcache *deltaBaseCache
+	nilcache.add("a.pack", 12, ObjectBlob, []byte("1234"))
+	if _, _, ok := nilcache.get("a.pack", 12); ok {
+		t.Error("nil cache should be empty")
+	}
+}
+
+func TestDeltaChain(t *testing.T) {
+	for _, limit := range []int64{-1, 0, 1000} {
+		repos, err := OpenRepositoryWithOptions("_testdata/deltachain.git", &RepositoryOptions{DeltaBaseCacheLimit: limit})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// read twice, the second time the bases are cached
+		for i := 0; i < 2; i++ {
+			blob, err := repos.LookupBlob(mustOidFromString(t, "df17b922100f2ddf3301c869a92d9921a117fe92"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s := blob.Size(); s != 4921 {
+				t.Errorf("limit %d: blob size should be 4921, got %d", limit, s)
+			}
+			if !bytes.HasSuffix(blob.Contents(), []byte("appended in revision 60\n")) {
+				t.Errorf("limit %d: wrong blob contents", limit)
+			}
+		}
+	}
+}
+
+func TestObjectCache(t *testing.T) {
+	repos, err := OpenRepositoryWithOptions("_testdata/testrepo.git", &RepositoryOptions{ObjectCacheSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	oid := mustOidFromString(t, "7647bdef73cde0888222b7ea00f5e83b151a25d0")
+	ci, err := repos.LookupCommit(oid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ci2, err := repos.LookupCommit(oid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ci != ci2 {
+		t.Error("second LookupCommit should return the cached commit")
+	}
+	// The tree of the commit is cached as well, looking up the parent
+	// commit and its tree evicts both.
+	if ci.Parent(0) == nil {
+		t.Fatal("parent commit not found")
+	}
+	ci2, err = repos.LookupCommit(oid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ci == ci2 {
+		t.Error("commit should have been evicted from the cache")
+	}
+
+	repos.Close()
+	if _, err = repos.LookupCommit(oid); err != ErrClosed {
+		t.Error("LookupCommit: expected ErrClosed, got", err)
+	}
+	if _, err = repos.LookupTree(ci.TreeId()); err != ErrClosed {
+		t.Error("LookupTree: expected ErrClosed, got", err)
+	}
+}
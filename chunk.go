@@ -0,0 +1,76 @@
+// Copyright (c) 2013 Patrick Gundlach, speedata (Berlin, Germany)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gogit
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Chunk ids used in multi-pack-index and commit-graph files
+const (
+	chunkPackNames    = 0x504e414d // "PNAM"
+	chunkOidFanout    = 0x4f494446 // "OIDF"
+	chunkOidLookup    = 0x4f49444c // "OIDL"
+	chunkObjectOffset = 0x4f4f4646 // "OOFF"
+	chunkLargeOffset  = 0x4c4f4646 // "LOFF"
+	chunkCommitData   = 0x43444154 // "CDAT"
+	chunkExtraEdges   = 0x45444745 // "EDGE"
+	chunkBaseGraphs   = 0x42415345 // "BASE"
+)
+
+// Read the table of contents of a chunk file (multi-pack-index,
+// commit-graph), which starts at position start of data. The table has
+// an entry (4 bytes id, 8 bytes offset) for each chunk and a terminating
+// entry, so the size of a chunk is the difference to the next offset.
+// Return the chunks by id.
+func readChunkTable(data []byte, start int, numChunks int) (map[uint32][]byte, error) {
+	if len(data) < start+(numChunks+1)*12 {
+		return nil, errors.New("chunk table truncated")
+	}
+	chunks := make(map[uint32][]byte, numChunks)
+	for i := 0; i < numChunks; i++ {
+		pos := start + i*12
+		id := binary.BigEndian.Uint32(data[pos : pos+4])
+		chunkStart := binary.BigEndian.Uint64(data[pos+4 : pos+12])
+		chunkEnd := binary.BigEndian.Uint64(data[pos+16 : pos+24])
+		if chunkStart > chunkEnd || chunkEnd > uint64(len(data)) {
+			return nil, fmt.Errorf("chunk %x out of bounds", id)
+		}
+		chunks[id] = data[chunkStart:chunkEnd]
+	}
+	return chunks, nil
+}
+
+// Read a fanout table (256 entries, 4 bytes each) from the chunk.
+func readFanoutChunk(chunk []byte, fanoutTable *[256]int64) error {
+	if len(chunk) != 256*4 {
+		return errors.New("wrong size of oid fanout chunk")
+	}
+	for i := range fanoutTable {
+		fanoutTable[i] = int64(binary.BigEndian.Uint32(chunk[i*4 : i*4+4]))
+		if i > 0 && fanoutTable[i] < fanoutTable[i-1] {
+			return fmt.Errorf("fanout table is not monotonic at entry %d", i)
+		}
+	}
+	return nil
+}
@@ -20,7 +20,10 @@
 
 package gogit
 
-import "bytes"
+import (
+	"bytes"
+	"time"
+)
 
 type Commit struct {
 	Author        *Signature
@@ -30,6 +33,7 @@ type Commit struct {
 	Tree          *Tree
 	treeId        *Oid
 	parents       []*Oid // sha1 strings
+	generation    uint64
 	repository    *Repository
 }
 
@@ -75,6 +79,14 @@ func (ci *Commit) TreeId() *Oid {
 	return ci.treeId
 }
 
+// Return the generation number of the commit from the commit-graph: 1
+// for root commits, otherwise one more than the maximum generation
+// number of the parents. Return 0 if the commit is not in the
+// commit-graph.
+func (ci *Commit) Generation() uint64 {
+	return ci.generation
+}
+
 // Parse commit information from the (uncompressed) raw
 // data from the commit object.
 // \n\n separate headers from message
@@ -90,6 +102,10 @@ l:
 		case eol > 0:
 			line := data[nextline : nextline+eol]
 			spacepos := bytes.IndexByte(line, ' ')
+			if spacepos < 0 {
+				nextline += eol + 1
+				continue
+			}
 			reftype := line[:spacepos]
 			switch string(reftype) {
 			case "tree":
@@ -129,8 +145,14 @@ l:
 	return commit, nil
 }
 
-// Find the commit object in the repository.
+// Find the commit object in the repository. The commit object is read
+// completely, so the commit stays usable after the repository is closed.
+// The generation number is taken from the commit-graph. To walk the
+// history without reading the commit objects, use LookupCommitNode.
 func (repos *Repository) LookupCommit(oid *Oid) (*Commit, error) {
+	if ci, ok := repos.objectCache.get(oid).(*Commit); ok {
+		return ci, nil
+	}
 	_, _, data, err := repos.getRawObject(oid)
 	if err != nil {
 		return nil, err
@@ -142,16 +164,114 @@ func (repos *Repository) LookupCommit(oid *Oid) (*Commit, error) {
 	ci.repository = repos
 	ci.Oid = oid
 
-	_, _, data, err = repos.getRawObject(ci.treeId)
+	tree, err := repos.LookupTree(ci.treeId)
 	if err != nil {
 		return nil, err
 	}
-	tree, err := parseTreeData(data)
+	ci.Tree = tree
+	entry, err := repos.lookupCommitGraph(oid)
 	if err != nil {
 		return nil, err
 	}
-	tree.Oid = ci.TreeId()
-	tree.repository = repos
-	ci.Tree = tree
+	if entry != nil {
+		ci.generation = entry.generation
+	}
+	repos.objectCache.add(oid, ci)
 	return ci, nil
 }
+
+// A CommitNode holds the parts of a commit needed to walk the history:
+// the parents, the root tree, the commit time and the generation number.
+// If the commit is in the commit-graph of the repository, this is read
+// from there, so looking up a commit node is much cheaper than looking up
+// the commit. Otherwise the commit object is read.
+type CommitNode struct {
+	oid        *Oid
+	treeId     *Oid
+	parents    []*Oid
+	when       time.Time
+	generation uint64
+	repository *Repository
+}
+
+// Find the commit node in the repository.
+func (repos *Repository) LookupCommitNode(oid *Oid) (*CommitNode, error) {
+	node := &CommitNode{oid: oid, repository: repos}
+	entry, err := repos.lookupCommitGraph(oid)
+	if err != nil {
+		return nil, err
+	}
+	if entry != nil {
+		node.treeId = entry.treeId
+		node.parents = entry.parents
+		node.when = time.Unix(entry.commitTime, 0)
+		node.generation = entry.generation
+		return node, nil
+	}
+
+	_, _, data, err := repos.getRawObject(oid)
+	if err != nil {
+		return nil, err
+	}
+	ci, err := parseCommitData(data)
+	if err != nil {
+		return nil, err
+	}
+	node.treeId = ci.treeId
+	node.parents = ci.parents
+	if ci.Committer != nil {
+		node.when = ci.Committer.When
+	}
+	return node, nil
+}
+
+// Get the id of the commit.
+func (n *CommitNode) Id() *Oid {
+	return n.oid
+}
+
+// Return oid of the (root) tree of this commit.
+func (n *CommitNode) TreeId() *Oid {
+	return n.treeId
+}
+
+// Return the number of parents of the commit. 0 if this is the
+// root commit, otherwise 1,2,...
+func (n *CommitNode) ParentCount() int {
+	return len(n.parents)
+}
+
+// Return oid of the parent number i (0-based index). Return nil if no such parent exists.
+func (n *CommitNode) ParentId(i int) *Oid {
+	if i >= len(n.parents) {
+		return nil
+	}
+	return n.parents[i]
+}
+
+// Return the node of parent number i (0-based index)
+func (n *CommitNode) Parent(i int) *CommitNode {
+	if i >= len(n.parents) {
+		return nil
+	}
+	parent, err := n.repository.LookupCommitNode(n.parents[i])
+	if err != nil {
+		return nil
+	}
+	return parent
+}
+
+// Return the commit time (the committer's date).
+func (n *CommitNode) When() time.Time {
+	return n.when
+}
+
+// Return the generation number of the commit, see Commit.Generation.
+func (n *CommitNode) Generation() uint64 {
+	return n.generation
+}
+
+// Read the complete commit.
+func (n *CommitNode) Commit() (*Commit, error) {
+	return n.repository.LookupCommit(n.oid)
+}
@@ -0,0 +1,340 @@
+// Copyright (c) 2013 Patrick Gundlach, speedata (Berlin, Germany)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gogit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/speedata/mmap-go"
+)
+
+const (
+	graphParentNone    = 0x70000000
+	graphExtraEdgeList = 0x80000000
+	graphLastEdge      = 0x80000000
+)
+
+// A commitGraphFile is objects/info/commit-graph or one layer of a
+// commit-graph chain in objects/info/commit-graphs.
+type commitGraphFile struct {
+	path     string
+	hashSize int
+
+	fanoutTable [256]int64
+
+	// These tables are sub-slices of the whole file as an mmap
+	shaTable   []byte
+	commitData []byte
+	extraEdges []byte
+	baseGraphs []byte
+
+	numBaseGraphs int
+
+	data mmap.MMap
+}
+
+func readCommitGraphFile(path string, hash HashAlgorithm) (*commitGraphFile, error) {
+	graph := &commitGraphFile{path: path, hashSize: hash.Size()}
+	var err error
+	graph.data, err = mapFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = graph.parse(); err != nil {
+		graph.close()
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return graph, nil
+}
+
+func (graph *commitGraphFile) parse() error {
+	data := graph.data
+	// signature, version, hash version, number of chunks, number of base
+	// commit-graph files
+	if len(data) < 8 || !bytes.HasPrefix(data, []byte("CGPH")) {
+		return errors.New("not a commit-graph file")
+	}
+	if data[4] != 1 {
+		return fmt.Errorf("unsupported commit-graph version %d", data[4])
+	}
+	if data[5] != byte(HashSHA1) && data[5] != byte(HashSHA256) {
+		return fmt.Errorf("unsupported hash version %d", data[5])
+	}
+	if hash := HashAlgorithm(data[5]); hash.Size() != graph.hashSize {
+		return fmt.Errorf("object format %s doesn't match the repository", hash)
+	}
+	graph.numBaseGraphs = int(data[7])
+	chunks, err := readChunkTable(data, 8, int(data[6]))
+	if err != nil {
+		return err
+	}
+	for _, id := range []uint32{chunkOidFanout, chunkOidLookup, chunkCommitData} {
+		if chunks[id] == nil {
+			return fmt.Errorf("required chunk %x missing", id)
+		}
+	}
+	if err = readFanoutChunk(chunks[chunkOidFanout], &graph.fanoutTable); err != nil {
+		return err
+	}
+	numCommits := graph.fanoutTable[255]
+	graph.shaTable = chunks[chunkOidLookup]
+	graph.commitData = chunks[chunkCommitData]
+	graph.extraEdges = chunks[chunkExtraEdges]
+	graph.baseGraphs = chunks[chunkBaseGraphs]
+	if int64(len(graph.shaTable)) != numCommits*int64(graph.hashSize) || int64(len(graph.commitData)) != numCommits*int64(graph.entrySize()) {
+		return errors.New("wrong size of oid lookup or commit data chunk")
+	}
+	if len(graph.baseGraphs) != graph.numBaseGraphs*graph.hashSize {
+		return errors.New("wrong size of base graphs chunk")
+	}
+	return nil
+}
+
+// Return the size of an entry in the commit data chunk: root tree id,
+// two parents and generation number plus commit time.
+func (graph *commitGraphFile) entrySize() int {
+	return graph.hashSize + 16
+}
+
+func (graph *commitGraphFile) numCommits() int64 {
+	return graph.fanoutTable[255]
+}
+
+func (graph *commitGraphFile) close() error {
+	if graph.data == nil {
+		return nil
+	}
+	err := graph.data.Unmap()
+	graph.data = nil
+	graph.shaTable, graph.commitData, graph.extraEdges, graph.baseGraphs = nil, nil, nil, nil
+	return err
+}
+
+// The commitGraph holds parent ids, root tree id, commit time and
+// generation number of commits, so these can be read without inflating
+// and parsing the commit objects. It is made of a single commit-graph
+// file or of the layers of a commit-graph chain (base layer first). A
+// commit is identified by its position in the graph, the commits of a
+// layer come after the commits of all layers below.
+type commitGraph struct {
+	layers []*commitGraphFile
+	// position of the first commit of each layer
+	offsets []int64
+}
+
+type commitGraphEntry struct {
+	treeId     *Oid
+	parents    []*Oid
+	generation uint64
+	commitTime int64
+}
+
+// Read the commit-graph of the objects directory objectsdir. Return nil if
+// there is no commit-graph.
+func readCommitGraph(objectsdir string, hash HashAlgorithm) (*commitGraph, error) {
+	path := filepath.Join(objectsdir, "info", "commit-graph")
+	if _, err := os.Stat(path); err == nil {
+		layer, err := readCommitGraphFile(path, hash)
+		if err != nil {
+			return nil, err
+		}
+		if layer.numBaseGraphs != 0 {
+			layer.close()
+			return nil, fmt.Errorf("%s: single commit-graph file with base graphs", path)
+		}
+		return &commitGraph{layers: []*commitGraphFile{layer}, offsets: []int64{0}}, nil
+	}
+
+	dir := filepath.Join(objectsdir, "info", "commit-graphs")
+	f, err := os.Open(filepath.Join(dir, "commit-graph-chain"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	graph := &commitGraph{}
+	var hashes [][]byte
+	var offset int64
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		line := bytes.TrimSpace(scan.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		layer, err := readCommitGraphFile(filepath.Join(dir, "graph-"+string(line)+".graph"), hash)
+		if err != nil {
+			graph.close()
+			return nil, err
+		}
+		graph.layers = append(graph.layers, layer)
+		graph.offsets = append(graph.offsets, offset)
+		offset += layer.numCommits()
+
+		// Each layer lists the hashes of all layers below
+		if layer.numBaseGraphs != len(hashes) {
+			graph.close()
+			return nil, fmt.Errorf("%s: wrong number of base graphs", layer.path)
+		}
+		size := hash.Size()
+		for i, h := range hashes {
+			if !bytes.Equal(layer.baseGraphs[i*size:i*size+size], h) {
+				graph.close()
+				return nil, fmt.Errorf("%s: base graphs don't match the commit-graph chain", layer.path)
+			}
+		}
+		h, err := hex.DecodeString(string(line))
+		if err != nil || len(h) != size {
+			graph.close()
+			return nil, fmt.Errorf("bad commit-graph name %q", line)
+		}
+		hashes = append(hashes, h)
+	}
+	if err := scan.Err(); err != nil {
+		graph.close()
+		return nil, err
+	}
+	return graph, nil
+}
+
+// Return the position of the commit in the graph.
+func (graph *commitGraph) find(oid *Oid) (int64, bool) {
+	for i, layer := range graph.layers {
+		if n, found := searchSHA(&layer.fanoutTable, layer.shaTable, layer.hashSize, oid.Bytes); found {
+			return graph.offsets[i] + n, true
+		}
+	}
+	return 0, false
+}
+
+// Return the layer that contains the commit at position pos and the
+// position within the layer.
+func (graph *commitGraph) layer(pos int64) (*commitGraphFile, int64, error) {
+	for i := len(graph.layers) - 1; i >= 0; i-- {
+		if pos >= graph.offsets[i] {
+			if local := pos - graph.offsets[i]; local < graph.layers[i].numCommits() {
+				return graph.layers[i], local, nil
+			}
+			break
+		}
+	}
+	return nil, 0, fmt.Errorf("commit position %d out of range in commit-graph", pos)
+}
+
+// Return the id of the commit at position pos.
+func (graph *commitGraph) oidAt(pos int64) (*Oid, error) {
+	layer, local, err := graph.layer(pos)
+	if err != nil {
+		return nil, err
+	}
+	size := int64(layer.hashSize)
+	return NewOid(layer.shaTable[local*size : local*size+size])
+}
+
+// Read the data of the commit at position pos.
+func (graph *commitGraph) entry(pos int64) (*commitGraphEntry, error) {
+	layer, local, err := graph.layer(pos)
+	if err != nil {
+		return nil, err
+	}
+	// root tree id, first parent, second parent, generation and commit time
+	size := int64(layer.entrySize())
+	data := layer.commitData[local*size : local*size+size]
+	entry := &commitGraphEntry{}
+	if entry.treeId, err = NewOid(data[:layer.hashSize]); err != nil {
+		return nil, err
+	}
+	data = data[layer.hashSize:]
+
+	var parents []uint32
+	parent1 := binary.BigEndian.Uint32(data[0:4])
+	parent2 := binary.BigEndian.Uint32(data[4:8])
+	if parent1 != graphParentNone {
+		parents = append(parents, parent1)
+	}
+	switch {
+	case parent2 == graphParentNone:
+	case parent2&graphExtraEdgeList != 0:
+		// Octopus merge: parent2 is the start of a list of the second
+		// and all following parents in the extra edges chunk, the last
+		// one is marked with the most significant bit.
+		for i := int(parent2 &^ graphExtraEdgeList); ; i++ {
+			if i*4+4 > len(layer.extraEdges) {
+				return nil, errors.New("extra edge list out of range in commit-graph")
+			}
+			edge := binary.BigEndian.Uint32(layer.extraEdges[i*4 : i*4+4])
+			parents = append(parents, edge&^graphLastEdge)
+			if edge&graphLastEdge != 0 {
+				break
+			}
+		}
+	default:
+		parents = append(parents, parent2)
+	}
+	entry.parents = make([]*Oid, len(parents))
+	for i, parent := range parents {
+		if entry.parents[i], err = graph.oidAt(int64(parent)); err != nil {
+			return nil, err
+		}
+	}
+
+	// The upper 30 bits are the generation number (topological level),
+	// the lower 34 bits the commit time in seconds since the epoch.
+	genAndTime := binary.BigEndian.Uint64(data[8:16])
+	entry.generation = genAndTime >> 34
+	entry.commitTime = int64(genAndTime & (1<<34 - 1))
+	return entry, nil
+}
+
+func (graph *commitGraph) close() error {
+	var err error
+	for _, layer := range graph.layers {
+		if e := layer.close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Return the commit-graph data of the commit or nil if the commit is not
+// in the commit-graph.
+func (repos *Repository) lookupCommitGraph(oid *Oid) (*commitGraphEntry, error) {
+	if err := repos.rlock(); err != nil {
+		return nil, err
+	}
+	defer repos.mu.RUnlock()
+	if repos.commitGraph == nil {
+		return nil, nil
+	}
+	pos, found := repos.commitGraph.find(oid)
+	if !found {
+		return nil, nil
+	}
+	return repos.commitGraph.entry(pos)
+}
@@ -0,0 +1,140 @@
+package gogit
+
+import (
+	"testing"
+)
+
+// The commits in _testdata/commitgraph.git. D merges B and C, H is an
+// octopus merge of E, F and G. A-D are in the base layer of the
+// commit-graph chain, E-H in the top layer.
+var commitGraphCommits = []struct {
+	name       string
+	oid        string
+	tree       string
+	parents    []string
+	time       int64
+	generation uint64
+}{
+	{"A", "1eb2fa05bfa4ec2fd0241340142114796d772814", "08585692ce06452da6f82ae66b90d98b55536fca", nil, 1378823654, 1},
+	{"B", "a9108afdac3c48eab438833b5546074e7afad1cd", "f4b354863caa9cea99b95422c9dab70465757d87", []string{"1eb2fa05bfa4ec2fd0241340142114796d772814"}, 1378823714, 2},
+	{"C", "63cc761adb0f1ab531df1eaa278779c5826e2c91", "4b0168100985e3ac1ad29ffe285f8e48a42a0a47", []string{"1eb2fa05bfa4ec2fd0241340142114796d772814"}, 1378823774, 2},
+	{"D", "4f87c119e6bb641331f3e44cf01a7b8545a8f551", "d11b5fac254c4b7a5a8e078cbad43ba15d6494ff", []string{"a9108afdac3c48eab438833b5546074e7afad1cd", "63cc761adb0f1ab531df1eaa278779c5826e2c91"}, 1378823834, 3},
+	{"E", "0c30cdd6e5fa7e2e6640344f65b30a5514c90afd", "b0afff433e8284dd0b3f832493f2b04deefa4480", []string{"4f87c119e6bb641331f3e44cf01a7b8545a8f551"}, 1378823894, 4},
+	{"F", "2abee7bbe0b8cb6380cc8e1a4ccdae32d33bf813", "cfd11ff6676b21bb1f6e9994605f9c2cebe1f02e", []string{"4f87c119e6bb641331f3e44cf01a7b8545a8f551"}, 1378823954, 4},
+	{"G", "a91c9815d5f01635b13c24acebddaa0382351926", "d0112d8e36473d77be086ee72f81b19901b69552", []string{"4f87c119e6bb641331f3e44cf01a7b8545a8f551"}, 1378824014, 4},
+	{"H", "9bdbafc01995b8e9ea4d3e4c5b95af64766646d4", "084ec36910e042b63fd0fe63c6f7c0f66376a36c", []string{"0c30cdd6e5fa7e2e6640344f65b30a5514c90afd", "2abee7bbe0b8cb6380cc8e1a4ccdae32d33bf813", "a91c9815d5f01635b13c24acebddaa0382351926"}, 1378824074, 5},
+}
+
+func TestCommitGraph(t *testing.T) {
+	repos, err := OpenRepository("_testdata/commitgraph.git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repos.Close()
+	if repos.commitGraph == nil {
+		t.Fatal("commit-graph chain not loaded")
+	}
+	if n := len(repos.commitGraph.layers); n != 2 {
+		t.Fatal("expected 2 commit-graph layers, got", n)
+	}
+	for _, c := range commitGraphCommits {
+		node, err := repos.LookupCommitNode(mustOidFromString(t, c.oid))
+		if err != nil {
+			t.Fatal(c.name, err)
+		}
+		if node.TreeId().String() != c.tree {
+			t.Errorf("%s: tree %s, want %s", c.name, node.TreeId(), c.tree)
+		}
+		if node.ParentCount() != len(c.parents) {
+			t.Fatalf("%s: %d parents, want %d", c.name, node.ParentCount(), len(c.parents))
+		}
+		for i, p := range c.parents {
+			if node.ParentId(i).String() != p {
+				t.Errorf("%s: parent %d is %s, want %s", c.name, i, node.ParentId(i), p)
+			}
+			if parent := node.Parent(i); parent == nil || parent.Id().String() != p {
+				t.Errorf("%s: cannot look up parent %d", c.name, i)
+			}
+		}
+		if node.ParentId(len(c.parents)) != nil {
+			t.Errorf("%s: unexpected parent", c.name)
+		}
+		if node.When().Unix() != c.time {
+			t.Errorf("%s: time %d, want %d", c.name, node.When().Unix(), c.time)
+		}
+		if node.Generation() != c.generation {
+			t.Errorf("%s: generation %d, want %d", c.name, node.Generation(), c.generation)
+		}
+		ci, err := node.Commit()
+		if err != nil {
+			t.Fatal(c.name, err)
+		}
+		if ci.Generation() != c.generation {
+			t.Errorf("%s: commit generation %d, want %d", c.name, ci.Generation(), c.generation)
+		}
+		if ci.TreeId().String() != c.tree {
+			t.Errorf("%s: commit tree %s, want %s", c.name, ci.TreeId(), c.tree)
+		}
+	}
+}
+
+// A commit looked up with the commit-graph stays usable after Close.
+func TestCommitFromCommitGraphAfterClose(t *testing.T) {
+	repos, err := OpenRepository("_testdata/commitgraph.git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := commitGraphCommits[7]
+	ci, err := repos.LookupCommit(mustOidFromString(t, c.oid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	repos.Close()
+	if ci.Author == nil || ci.Committer == nil || ci.Message() == "" {
+		t.Fatal("commit object not read")
+	}
+	if ci.Committer.When.Unix() != c.time {
+		t.Errorf("time %d, want %d", ci.Committer.When.Unix(), c.time)
+	}
+	if ci.Tree == nil || ci.Tree.Oid.String() != c.tree {
+		t.Error("wrong tree")
+	}
+	if ci.ParentCount() != len(c.parents) || ci.ParentId(2).String() != c.parents[2] {
+		t.Error("wrong parents")
+	}
+	if ci.Generation() != c.generation {
+		t.Errorf("generation %d, want %d", ci.Generation(), c.generation)
+	}
+}
+
+func TestCommitNodeWithoutCommitGraph(t *testing.T) {
+	repos, err := OpenRepository("_testdata/testrepo.git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repos.Close()
+	if repos.commitGraph != nil {
+		t.Fatal("unexpected commit-graph")
+	}
+	oid := mustOidFromString(t, "1337a1a1b0694887722f8bd0e541bd0f6567a471")
+	node, err := repos.LookupCommitNode(oid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ci, err := repos.LookupCommit(oid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.Generation() != 0 || ci.Generation() != 0 {
+		t.Error("generation number without commit-graph")
+	}
+	if !node.TreeId().Equal(ci.TreeId()) {
+		t.Error("tree ids differ")
+	}
+	if node.ParentCount() != ci.ParentCount() {
+		t.Error("parent counts differ")
+	}
+	if !node.When().Equal(ci.Committer.When) {
+		t.Error("commit times differ")
+	}
+}
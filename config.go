@@ -0,0 +1,105 @@
+// Copyright (c) 2013 Patrick Gundlach, speedata (Berlin, Germany)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gogit
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+// Read the git config file at path. The keys of the returned map are the
+// lower case section name, the subsection name (if any) and the lower
+// case variable name, separated by dots, for example
+// "extensions.objectformat" or "remote.origin.url". A variable without a
+// value is "true". If a variable is set more than once, the last value
+// wins. A missing file is an empty config.
+func readConfig(path string) (map[string]string, error) {
+	config := make(map[string]string)
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return config, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var section string
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		line := strings.TrimSpace(scan.Text())
+		if len(line) == 0 || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' {
+			end := strings.IndexByte(line, ']')
+			if end < 0 {
+				continue
+			}
+			name := strings.TrimSpace(line[1:end])
+			// [remote "origin"], the subsection is case sensitive
+			if sp := strings.IndexByte(name, ' '); sp >= 0 {
+				sub := strings.Trim(strings.TrimSpace(name[sp:]), `"`)
+				section = strings.ToLower(name[:sp]) + "." + sub
+			} else {
+				section = strings.ToLower(name)
+			}
+			line = strings.TrimSpace(line[end+1:])
+			if len(line) == 0 {
+				continue
+			}
+		}
+		key, value := line, "true"
+		if eq := strings.IndexByte(line, '='); eq >= 0 {
+			key, value = strings.TrimSpace(line[:eq]), parseConfigValue(line[eq+1:])
+		}
+		config[section+"."+strings.ToLower(key)] = value
+	}
+	return config, scan.Err()
+}
+
+// Remove comments and quotes from a config value.
+func parseConfigValue(s string) string {
+	var value []byte
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == '\\' && i+1 < len(s):
+			i++
+			switch s[i] {
+			case 'n':
+				value = append(value, '\n')
+			case 't':
+				value = append(value, '\t')
+			default:
+				value = append(value, s[i])
+			}
+		case (c == '#' || c == ';') && !quoted:
+			return strings.TrimSpace(string(value))
+		default:
+			value = append(value, c)
+		}
+	}
+	return strings.TrimSpace(string(value))
+}
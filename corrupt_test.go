@@ -0,0 +1,264 @@
+package gogit
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestApplyDeltaCorrupt(t *testing.T) {
+	base := []byte("0123456789")
+	testdata := []struct {
+		name      string
+		delta     []byte
+		resultLen int64
+	}{
+		{"copy beyond base", []byte{0x91, 0x08, 0x05}, 5},
+		{"copy beyond result", []byte{0x91, 0x00, 0x05}, 3},
+		{"insert beyond result", []byte{0x03, 'a', 'b', 'c'}, 2},
+		{"insert truncated", []byte{0x05, 'a', 'b'}, 5},
+		{"copy arguments truncated", []byte{0x91, 0x00}, 5},
+		{"result too short", []byte{0x02, 'a', 'b'}, 5},
+		{"opcode 0", []byte{0x00}, 1},
+		{"negative length", []byte{}, -1},
+		{"huge length", []byte{0x01, 'a'}, 1 << 40},
+	}
+	for _, td := range testdata {
+		if _, err := applyDelta(td.delta, base, td.resultLen); err == nil {
+			t.Errorf("%s: expected error", td.name)
+		}
+	}
+	result, err := applyDelta([]byte{0x91, 0x02, 0x03, 0x02, 'a', 'b'}, base, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != "234ab" {
+		t.Errorf("wrong result %q", result)
+	}
+}
+
+func TestReadNumbersTruncated(t *testing.T) {
+	if _, n := readLittleEndianBase128Number([]byte{0x80, 0x80}); n != 0 {
+		t.Error("expected 0 bytes read for a truncated number")
+	}
+	if _, n := readLittleEndianBase128Number([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}); n != 0 {
+		t.Error("expected 0 bytes read for a number too large")
+	}
+	if _, advance := readLenInPackFile([]byte{0x9f, 0x80}); advance != 0 {
+		t.Error("expected advance 0 for a truncated length")
+	}
+	if _, advance := readLenInPackFile(nil); advance != 0 {
+		t.Error("expected advance 0 for an empty buffer")
+	}
+	for _, b := range []string{"", "12", "\x00", "1a\x00", "99999999999999999999\x00"} {
+		if _, _, err := getLengthZeroTerminated([]byte(b)); err == nil {
+			t.Errorf("getLengthZeroTerminated(%q): expected error", b)
+		}
+	}
+	if l, pos, err := getLengthZeroTerminated([]byte("1234\x00data")); l != 1234 || pos != 5 || err != nil {
+		t.Error("getLengthZeroTerminated: wrong result", l, pos, err)
+	}
+}
+
+// Parsing truncated objects must not panic.
+func TestParseTruncatedObjects(t *testing.T) {
+	repos, err := OpenRepository("_testdata/testrepo.git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repos.Close()
+	objects := map[string]func([]byte){
+		"1337a1a1b0694887722f8bd0e541bd0f6567a471": func(b []byte) { parseCommitData(b) },
+		"e34a238bd4523af233c27b0196c78a7d722e0d0a": func(b []byte) { parseTreeData(b, 20) },
+		"e6f8d0db36fd0e048979d115478abec90682bd78": func(b []byte) { parseTagData(b) },
+	}
+	for oid, parse := range objects {
+		_, _, data, err := repos.getRawObject(mustOidFromString(t, oid))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i <= len(data); i++ {
+			parse(data[:i])
+		}
+	}
+	if _, err = newSignatureFromCommitline([]byte("no email 1378823654 +0200")); err == nil {
+		t.Error("expected error for a signature without email")
+	}
+	if _, err = newSignatureFromCommitline([]byte("Name <email>")); err == nil {
+		t.Error("expected error for a signature without time")
+	}
+}
+
+// Reading objects from a pack file with a damaged byte must return an
+// error or (if the damage is in unused data) the object, but never panic.
+func TestCorruptPackFile(t *testing.T) {
+	idx, err := readIdxFile("_testdata/testrepo.git/objects/pack/pack-efa084d62d89521059a514772fd2966a3a230984.idx", HashSHA1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := idx.packMmap
+	defer func() {
+		idx.packMmap = orig
+		idx.close()
+	}()
+	var offsets []uint64
+	for pos := 0; pos < len(idx.shaTable); pos += 20 {
+		offsets = append(offsets, idx.offsetForSHA(idx.shaTable[pos:pos+20]))
+	}
+	repos := &Repository{}
+	pack := make([]byte, len(orig))
+	// Damage every fifth byte, every byte takes too long
+	for i := 0; i < len(orig); i += 5 {
+		copy(pack, orig)
+		pack[i] ^= 0xff
+		idx.packMmap = pack
+		for _, offset := range offsets {
+			repos.readObjectBytes(idx, offset, false)
+			repos.readObjectBytes(idx, offset, true)
+			if !idx.acquire() {
+				t.Fatal("pack closed")
+			}
+			idx.release()
+			_, _, rc, err := repos.readObjectStream(idx, offset)
+			if err == nil {
+				io.Copy(ioutil.Discard, rc)
+				rc.Close()
+			}
+		}
+	}
+}
+
+func TestLimits(t *testing.T) {
+	// df17b922... is a blob of 4921 bytes at the end of a chain of 48
+	// deltas.
+	oid := mustOidFromString(t, "df17b922100f2ddf3301c869a92d9921a117fe92")
+
+	repos, err := OpenRepositoryWithOptions("_testdata/deltachain.git", &RepositoryOptions{MaxObjectSize: 4000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = repos.LookupBlob(oid); err != ErrObjectTooLarge {
+		t.Error("LookupBlob: expected ErrObjectTooLarge, got", err)
+	}
+	if _, _, err = repos.BlobReader(oid); err != ErrObjectTooLarge {
+		t.Error("BlobReader: expected ErrObjectTooLarge, got", err)
+	}
+	if size, err := repos.ObjectSize(oid); size != 4921 || err != nil {
+		t.Error("ObjectSize should not be limited", size, err)
+	}
+	repos.Close()
+
+	repos, err = OpenRepositoryWithOptions("_testdata/deltachain.git", &RepositoryOptions{MaxDeltaDepth: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = repos.LookupBlob(oid); err != ErrDeltaChainTooDeep {
+		t.Error("LookupBlob: expected ErrDeltaChainTooDeep, got", err)
+	}
+	if _, _, err = repos.BlobReader(oid); err != ErrDeltaChainTooDeep {
+		t.Error("BlobReader: expected ErrDeltaChainTooDeep, got", err)
+	}
+	if _, err = repos.Type(oid); err != ErrDeltaChainTooDeep {
+		t.Error("Type: expected ErrDeltaChainTooDeep, got", err)
+	}
+	repos.Close()
+
+	repos, err = OpenRepositoryWithOptions("_testdata/deltachain.git", &RepositoryOptions{MaxDeltaDepth: 48})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repos.Close()
+	if _, err = repos.LookupBlob(oid); err != nil {
+		t.Error(err)
+	}
+}
+
+// A loose object whose data doesn't match the size in its header.
+func TestBlobReaderWrongSize(t *testing.T) {
+	dir := copyRepository(t, "_testdata/testrepo.git")
+	defer os.RemoveAll(dir)
+	testdata := []struct {
+		oid    string
+		header string
+		data   string
+	}{
+		{"1111111111111111111111111111111111111111", "blob 27\x00", "short"},
+		{"2222222222222222222222222222222222222222", "blob 5\x00", "more than 5 bytes\n"},
+	}
+	for _, td := range testdata {
+		var buf bytes.Buffer
+		zw := zlib.NewWriter(&buf)
+		zw.Write([]byte(td.header + td.data))
+		zw.Close()
+		path := filepathFromSHA1(filepath.Join(dir, "objects"), td.oid)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, buf.Bytes(), 0444); err != nil {
+			t.Fatal(err)
+		}
+	}
+	repos, err := OpenRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repos.Close()
+	for i, td := range testdata {
+		rc, _, err := repos.BlobReader(mustOidFromString(t, td.oid))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ioutil.ReadAll(rc)
+		rc.Close()
+		if err == nil || i == 0 && err != io.ErrUnexpectedEOF {
+			t.Errorf("%s: expected error, got %v", td.oid, err)
+		}
+	}
+}
+
+// A packed object whose data doesn't match the size in its entry header.
+func TestObjectStreamWrongSize(t *testing.T) {
+	idx, err := readIdxFile("_testdata/testrepo.git/objects/pack/pack-efa084d62d89521059a514772fd2966a3a230984.idx", HashSHA1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := idx.packMmap
+	defer func() {
+		idx.packMmap = orig
+		idx.close()
+	}()
+	// An undeltified object with a length that can be changed by one in
+	// the first byte of the header
+	var offset uint64
+	for n := int64(0); n < int64(len(idx.shaTable)/20); n++ {
+		o := idx.offsetAt(n)
+		entry, err := readPackEntry(orig, int64(o), 20)
+		if err == nil && entry.ot != objectOfsDelta && entry.ot != objectRefDelta && orig[o]&0x0f > 0 && orig[o]&0x0f < 0x0f {
+			offset = o
+			break
+		}
+	}
+	if offset == 0 {
+		t.Fatal("no suitable object in pack")
+	}
+	repos := &Repository{}
+	pack := make([]byte, len(orig))
+	for _, change := range []int{1, -1} {
+		copy(pack, orig)
+		pack[offset] = byte(int(pack[offset]) + change)
+		idx.packMmap = pack
+		_, _, rc, err := repos.readObjectStream(idx, offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ioutil.ReadAll(rc)
+		rc.Close()
+		if err == nil || change > 0 && err != io.ErrUnexpectedEOF {
+			t.Errorf("length changed by %d: expected error, got %v", change, err)
+		}
+	}
+}
@@ -1,9 +1,17 @@
 package gogit
 
 import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 // mustOidFromString calls NewOidFromString and calls tb.Fatal in case of error.
@@ -15,6 +23,37 @@ func mustOidFromString(tb testing.TB, sha1 string) *Oid {
 	return o
 }
 
+// copyRepository copies the repository at src into a temporary directory
+// and returns its path. The caller must remove the directory.
+func copyRepository(tb testing.TB, src string) string {
+	dst, err := ioutil.TempDir("", "gogit")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	err = filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return os.MkdirAll(filepath.Join(dst, rel), 0755)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(filepath.Join(dst, rel), data, info.Mode())
+	})
+	if err != nil {
+		os.RemoveAll(dst)
+		tb.Fatal(err)
+	}
+	return dst
+}
+
 func TestOpen(t *testing.T) {
 	_, err := OpenRepository("xxxxxxxx")
 	if err == nil {
@@ -28,10 +67,13 @@ func TestOpen(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
+	if ref.Name != "HEAD" {
+		t.Error("in ref.Name", ref.Name, "is not HEAD")
+	}
 	exp := "refs/heads/master"
-	res := ref.Name
+	res := ref.SymbolicTarget()
 	if res != exp {
-		t.Error("in ref.Name", res, "is not", exp)
+		t.Error("in ref.SymbolicTarget()", res, "is not", exp)
 	}
 
 	// Not sure if resolveInfo is really needed, it seems to be for
@@ -64,10 +106,11 @@ func TestOid(t *testing.T) {
 }
 
 func TestIdxFile(t *testing.T) {
-	idx, err := readIdxFile("_testdata/testrepo.git/objects/pack/pack-efa084d62d89521059a514772fd2966a3a230984.idx")
+	idx, err := readIdxFile("_testdata/testrepo.git/objects/pack/pack-efa084d62d89521059a514772fd2966a3a230984.idx", HashSHA1)
 	if err != nil {
-		t.Error("Index file could not be read")
+		t.Fatal("Index file could not be read")
 	}
+	repos := &Repository{}
 	// A commit:
 	// $ git cat-file -p 7647bdef73cde0888222b7ea00f5e83b151a25d0
 	// tree b9a560f9a96f89f3a44508689592ef4b10cc5d22
@@ -82,7 +125,7 @@ func TestIdxFile(t *testing.T) {
 	if offset != exp {
 		t.Error("Offset should be", exp, "but is", offset)
 	}
-	objtype, _, b, err := readObjectBytes(idx.packpath, offset, false)
+	objtype, _, b, err := repos.readObjectBytes(idx, offset, false)
 	if err != nil {
 		t.Error(err)
 	}
@@ -112,7 +155,7 @@ func TestIdxFile(t *testing.T) {
 	if offset != exp {
 		t.Error("Offset should be", exp, "but is", offset)
 	}
-	objtype, _, b, err = readObjectBytes(idx.packpath, offset, false)
+	objtype, _, b, err = repos.readObjectBytes(idx, offset, false)
 	if err != nil {
 		t.Error(err)
 	}
@@ -129,6 +172,181 @@ func TestIdxFile(t *testing.T) {
 	}
 }
 
+func TestIdxFileV1(t *testing.T) {
+	v1, err := readIdxFile("_testdata/idxv1.git/objects/pack/pack-efa084d62d89521059a514772fd2966a3a230984.idx", HashSHA1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v1.close()
+	v2, err := readIdxFile("_testdata/testrepo.git/objects/pack/pack-efa084d62d89521059a514772fd2966a3a230984.idx", HashSHA1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v2.close()
+	if v1.version != 1 || v2.version != 2 {
+		t.Fatal("wrong idx versions", v1.version, v2.version)
+	}
+	if v1.fanoutTable != v2.fanoutTable || !bytes.Equal(v1.shaTable, v2.shaTable) {
+		t.Fatal("version 1 and version 2 idx files differ")
+	}
+	for pos := 0; pos < len(v2.shaTable); pos += 20 {
+		sha := v2.shaTable[pos : pos+20]
+		if v1.offsetForSHA(sha) != v2.offsetForSHA(sha) {
+			t.Errorf("offsets of %x differ", sha)
+		}
+	}
+
+	repos, err := OpenRepository("_testdata/idxv1.git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repos.Close()
+	ci, err := repos.LookupCommit(mustOidFromString(t, "7647bdef73cde0888222b7ea00f5e83b151a25d0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ci.Message() != "Change symlink to file/add symlink to dir" {
+		t.Errorf("wrong commit message %q", ci.Message())
+	}
+}
+
+func TestCorruptIdxFile(t *testing.T) {
+	dir := copyRepository(t, "_testdata/testrepo.git")
+	defer os.RemoveAll(dir)
+	packbase := filepath.Join(dir, "objects", "pack", "pack-efa084d62d89521059a514772fd2966a3a230984")
+	idxpath := packbase + ".idx"
+	orig, err := ioutil.ReadFile(idxpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Write the idx file with a correct checksum
+	writeIdx := func(data []byte) {
+		sum := sha1.Sum(data[:len(data)-20])
+		copy(data[len(data)-20:], sum[:])
+		if err := ioutil.WriteFile(idxpath, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	modified := func(f func(data []byte)) []byte {
+		data := append([]byte(nil), orig...)
+		f(data)
+		return data
+	}
+
+	// wrong checksum, only checked by Verify
+	if err = ioutil.WriteFile(idxpath, modified(func(data []byte) { data[2000] ^= 1 }), 0644); err != nil {
+		t.Fatal(err)
+	}
+	idx, err := readIdxFile(idxpath, HashSHA1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = idx.checkChecksum(HashSHA1)
+	idx.close()
+	if e, ok := err.(*CorruptIndexError); !ok || e.Path != idxpath || !strings.Contains(e.Error(), "checksum") {
+		t.Error("expected checksum error, got", err)
+	}
+	if res := verifyRepository(t, dir); !hasProblem(res, VerifyPackChecksum, "") || res.Problems[0].Path != idxpath {
+		t.Errorf("idx checksum mismatch not reported: %v", res.Problems)
+	}
+
+	// unknown version
+	writeIdx(modified(func(data []byte) { data[7] = 3 }))
+	_, err = readIdxFile(idxpath, HashSHA1)
+	if e, ok := err.(*UnsupportedIndexVersionError); !ok || e.Version != 3 || e.Path != idxpath {
+		t.Error("expected unsupported version error, got", err)
+	}
+
+	// fanout entry 0x10 larger than entry 0x11
+	writeIdx(modified(func(data []byte) { data[8+0x10*4] = 1 }))
+	_, err = readIdxFile(idxpath, HashSHA1)
+	if e, ok := err.(*CorruptIndexError); !ok || !strings.Contains(e.Reason, "monotonic") {
+		t.Error("expected fanout error, got", err)
+	}
+
+	// truncated
+	writeIdx(modified(func(data []byte) {})[100:])
+	_, err = readIdxFile(idxpath, HashSHA1)
+	if _, ok := err.(*CorruptIndexError); !ok {
+		t.Error("expected corrupt index error, got", err)
+	}
+
+	// pack file doesn't match the idx file
+	writeIdx(modified(func(data []byte) {}))
+	pack, err := ioutil.ReadFile(packbase + ".pack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pack[len(pack)-1] ^= 1
+	if err = ioutil.WriteFile(packbase+".pack", pack, 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = readIdxFile(idxpath, HashSHA1)
+	if e, ok := err.(*CorruptIndexError); !ok || e.Path != idxpath || !strings.Contains(e.Reason, "pack checksum") {
+		t.Error("expected pack checksum error, got", err)
+	}
+	// Like git, the repository can be opened without the pack
+	repos, err := OpenRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repos.Close()
+	if len(repos.stores[0].indexfiles) != 0 {
+		t.Error("unreadable idx file should be skipped")
+	}
+	res, err := repos.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Problems) == 0 || res.Problems[0].Kind != VerifyUnreadable || res.Problems[0].Path != idxpath || !strings.Contains(res.Problems[0].Message, "pack checksum") {
+		t.Errorf("unreadable idx file not reported: %v", res.Problems)
+	}
+}
+
+func TestRefDelta(t *testing.T) {
+	repos, err := OpenRepository("_testdata/refdelta.git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// file.txt of every commit. All but the base 0a7931 are stored as
+	// REF_DELTA objects, e6f9e4 (and the ones based on it) have their base
+	// in a different pack file.
+	tests := [...]struct {
+		oid  string
+		size int
+		tail string
+	}{
+		{oid: "4dccfcad5b24135bf414c25c6135062a6d52f2b5", size: 10682, tail: "appended in revision 1\n"},
+		{oid: "b371abcdc3aa99c0f688e19811bfce76cefff2e4", size: 10697, tail: "appended in revision 2\n"},
+		{oid: "0a7931bca29903ab11a5c5508e93ecf0d73f4ea9", size: 10735, tail: "appended in revision 3\n"},
+		{oid: "e6f9e488b8e28cdcd8d4ee281f9d5cc908c1005c", size: 10796, tail: "appended in revision 4\n"},
+		{oid: "5515a2016c0c43293b3738004bc8c534d463cd45", size: 10879, tail: "appended in revision 5\n"},
+		{oid: "4a7664aedd17b438b46ec999386c2c23767d5354", size: 10985, tail: "appended in revision 6\n"},
+	}
+	for _, test := range tests {
+		blob, err := repos.LookupBlob(mustOidFromString(t, test.oid))
+		if err != nil {
+			t.Errorf("LookupBlob(%s) failed: %v", test.oid, err)
+			continue
+		}
+		if s := blob.Size(); s != test.size {
+			t.Errorf("LookupBlob(%s) size = %d want %d", test.oid, s, test.size)
+		}
+		if !strings.HasSuffix(string(blob.Contents()), test.tail) {
+			t.Errorf("LookupBlob(%s) does not end with %q", test.oid, test.tail)
+		}
+	}
+
+	// A deltified commit
+	ci, err := repos.LookupCommit(mustOidFromString(t, "380474ca1fa33a55e3a46a5e9627b313dcf9d54e"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ci.Message() != "Revision 1\n" {
+		t.Errorf("commit message = %q want %q", ci.Message(), "Revision 1\n")
+	}
+}
+
 func TestLookupCommit(t *testing.T) {
 	repos, err := OpenRepository("_testdata/testrepo.git")
 	if err != nil {
@@ -281,6 +499,316 @@ func TestBlob(t *testing.T) {
 	}
 }
 
+func TestBlobReader(t *testing.T) {
+	tests := [...]struct {
+		repo string
+		oid  string
+	}{
+		{repo: "_testdata/testrepo.git", oid: "5c41408e01a1cb93ff684882e10dfa418bf0d043"}, // loose object
+		{repo: "_testdata/testrepo.git", oid: "6c493ff740f9380390d5c9ddef4af18697ac9375"}, // packed
+		{repo: "_testdata/refdelta.git", oid: "4dccfcad5b24135bf414c25c6135062a6d52f2b5"}, // delta chain
+		{repo: "_testdata/refdelta.git", oid: "4a7664aedd17b438b46ec999386c2c23767d5354"}, // base in other pack
+	}
+	for _, test := range tests {
+		repos, err := OpenRepository(test.repo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		oid := mustOidFromString(t, test.oid)
+		blob, err := repos.LookupBlob(oid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, size, err := repos.BlobReader(oid)
+		if err != nil {
+			t.Errorf("BlobReader(%s) failed: %v", test.oid, err)
+			repos.Close()
+			continue
+		}
+		if size != int64(blob.Size()) {
+			t.Errorf("BlobReader(%s) size = %d want %d", test.oid, size, blob.Size())
+		}
+		data, err := ioutil.ReadAll(iotest.OneByteReader(r))
+		if err != nil {
+			t.Errorf("reading BlobReader(%s) failed: %v", test.oid, err)
+		}
+		if !bytes.Equal(data, blob.Contents()) {
+			t.Errorf("BlobReader(%s) contents differ from LookupBlob", test.oid)
+		}
+		if err = r.Close(); err != nil {
+			t.Error(err)
+		}
+		repos.Close()
+	}
+
+	repos, err := OpenRepository("_testdata/testrepo.git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repos.Close()
+	if _, _, err = repos.BlobReader(mustOidFromString(t, "7cc610f7268f024d3684a3778ff5aac89c2515bc")); err == nil {
+		t.Error("BlobReader should fail on a tree")
+	}
+}
+
+func TestClose(t *testing.T) {
+	repos, err := OpenRepository("_testdata/testrepo.git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _, err := repos.BlobReader(mustOidFromString(t, "6c493ff740f9380390d5c9ddef4af18697ac9375"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = repos.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// The pack file is still in use by the reader
+	idx := repos.stores[0].indexfiles[0]
+	if idx.packMmap == nil {
+		t.Fatal("pack file unmapped while still in use")
+	}
+	if _, err = ioutil.ReadAll(r); err != nil {
+		t.Error(err)
+	}
+	r.Close()
+	if idx.packMmap != nil || idx.idxMmap != nil {
+		t.Error("pack and idx file should be unmapped after closing the last reader")
+	}
+}
+
+func TestUseAfterClose(t *testing.T) {
+	repos, err := OpenRepository("_testdata/testrepo.git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ci, err := repos.LookupCommit(mustOidFromString(t, "7647bdef73cde0888222b7ea00f5e83b151a25d0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = repos.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = repos.Close(); err != nil {
+		t.Error("second Close failed:", err)
+	}
+
+	oid := mustOidFromString(t, "6c493ff740f9380390d5c9ddef4af18697ac9375")
+	if _, err = repos.LookupBlob(oid); err != ErrClosed {
+		t.Error("LookupBlob: expected ErrClosed, got", err)
+	}
+	if _, _, err = repos.BlobReader(oid); err != ErrClosed {
+		t.Error("BlobReader: expected ErrClosed, got", err)
+	}
+	if _, err = repos.LookupCommit(oid); err != ErrClosed {
+		t.Error("LookupCommit: expected ErrClosed, got", err)
+	}
+	if _, err = repos.LookupTree(oid); err != ErrClosed {
+		t.Error("LookupTree: expected ErrClosed, got", err)
+	}
+	if _, err = repos.LookupTag(oid); err != ErrClosed {
+		t.Error("LookupTag: expected ErrClosed, got", err)
+	}
+	if _, err = repos.LookupReference("HEAD"); err != ErrClosed {
+		t.Error("LookupReference: expected ErrClosed, got", err)
+	}
+	if _, err = repos.Type(oid); err != ErrClosed {
+		t.Error("Type: expected ErrClosed, got", err)
+	}
+	if _, err = repos.ObjectSize(oid); err != ErrClosed {
+		t.Error("ObjectSize: expected ErrClosed, got", err)
+	}
+
+	// Objects read before Close are still usable
+	if ci.Tree.EntryCount() != 7 {
+		t.Error("Expected 7 entries in the tree, got", ci.Tree.EntryCount())
+	}
+	if ci.Parent(0) != nil {
+		t.Error("Parent should be nil after Close")
+	}
+	// Subtrees can't be read any more
+	if err = ci.Tree.Walk(func(string, *TreeEntry) int { return 0 }); err != ErrClosed {
+		t.Error("Walk: expected ErrClosed, got", err)
+	}
+}
+
+// Run with -race
+func TestConcurrentLookups(t *testing.T) {
+	repos, err := OpenRepositoryWithOptions("_testdata/refdelta.git", &RepositoryOptions{ObjectCacheSize: 4, DeltaBaseCacheLimit: 20000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repos.Close()
+	commits := []string{
+		"380474ca1fa33a55e3a46a5e9627b313dcf9d54e",
+		"9ee5a1f83d8892caf4027a86122eeb69b5ae36b7",
+		"cfb397b31c8d7fbf8959937056c0f2b0d7cfbef8",
+		"51bbc8e7ecafebeccab9fd16e8b68de51b5c5aa1",
+		"7eede41c4d064190cb6da3032b9026e725239caf",
+		"6561ff32ab209820886ec12a7a2f71270f473828",
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				oid := mustOidFromString(t, commits[(g+i)%len(commits)])
+				ci, err := repos.LookupCommit(oid)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				want := fmt.Sprintf("Revision %d\n", (g+i)%len(commits)+1)
+				if ci.Message() != want {
+					t.Errorf("commit %s: message %q want %q", oid, ci.Message(), want)
+				}
+				te := ci.Tree.EntryByName("file.txt")
+				blob, err := repos.LookupBlob(te.Id)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				r, size, err := repos.BlobReader(te.Id)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				data, err := ioutil.ReadAll(r)
+				r.Close()
+				if err != nil || size != int64(len(data)) || !bytes.Equal(data, blob.Contents()) {
+					t.Errorf("BlobReader(%s) differs from LookupBlob", te.Id)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+func TestRescanPacks(t *testing.T) {
+	dir := copyRepository(t, "_testdata/testrepo.git")
+	defer os.RemoveAll(dir)
+	repos, err := OpenRepositoryWithOptions(dir, &RepositoryOptions{PackRescanInterval: time.Nanosecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repos.Close()
+
+	// A new pack file shows up
+	chainblob := mustOidFromString(t, "df17b922100f2ddf3301c869a92d9921a117fe92")
+	if _, err = repos.LookupBlob(chainblob); err == nil {
+		t.Fatal("blob should not be in the repository yet")
+	}
+	for _, ext := range []string{".pack", ".idx"} {
+		name := "pack-8efc755d17ce9e54fc167dad90be08df3e52d19a" + ext
+		data, err := ioutil.ReadFile(filepath.Join("_testdata/deltachain.git/objects/pack", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(filepath.Join(dir, "objects/pack", name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(time.Millisecond)
+	if _, err = repos.LookupBlob(chainblob); err != nil {
+		t.Error("blob in new pack file not found:", err)
+	}
+
+	// The original pack file is removed
+	for _, ext := range []string{".pack", ".idx"} {
+		if err = os.Remove(filepath.Join(dir, "objects/pack/pack-efa084d62d89521059a514772fd2966a3a230984"+ext)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Still mapped, so it can be read until the next rescan
+	packedblob := mustOidFromString(t, "6c493ff740f9380390d5c9ddef4af18697ac9375")
+	if _, err = repos.LookupBlob(packedblob); err != nil {
+		t.Error(err)
+	}
+	time.Sleep(time.Millisecond)
+	if _, err = repos.LookupBlob(mustOidFromString(t, "0000000000000000000000000000000000000001")); err != errObjNotFound {
+		t.Error("expected errObjNotFound, got", err)
+	}
+	if _, err = repos.LookupBlob(packedblob); err != errObjNotFound {
+		t.Error("expected errObjNotFound for object in removed pack file, got", err)
+	}
+	if n := len(repos.stores[0].indexfiles); n != 1 {
+		t.Error("expected 1 pack file, got", n)
+	}
+	if _, err = repos.LookupBlob(chainblob); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAlternates(t *testing.T) {
+	// alternates.git has one commit on top of testrepo.git, all other
+	// objects are in testrepo.git
+	repos, err := OpenRepository("_testdata/alternates.git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repos.Close()
+	ci, err := repos.LookupCommit(mustOidFromString(t, "420b6a6e309868514fb7caed48340c99594edfb2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ci.Tree.EntryByName("alternates.txt") == nil {
+		t.Error("alternates.txt not found")
+	}
+	// loose object in testrepo.git
+	if ci.Parent(0) == nil {
+		t.Error("parent commit not found")
+	}
+	// packed object in testrepo.git
+	if _, err = repos.LookupBlob(mustOidFromString(t, "6c493ff740f9380390d5c9ddef4af18697ac9375")); err != nil {
+		t.Error(err)
+	}
+
+	// a and b are alternates of each other, b also uses testrepo.git
+	dir, err := ioutil.TempDir("", "gogit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	testrepo, err := filepath.Abs("_testdata/testrepo.git/objects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alternates := map[string]string{
+		"a": "../../b/objects\n",
+		"b": "# comment\n" + testrepo + "\n../../a/objects\n../../doesnotexist/objects\n",
+		"c": "",
+	}
+	for name, contents := range alternates {
+		if err = os.MkdirAll(filepath.Join(dir, name, "objects", "info"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(filepath.Join(dir, name, "objects", "info", "alternates"), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	repos, err = OpenRepository(filepath.Join(dir, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repos.Close()
+	if n := len(repos.stores); n != 3 {
+		t.Error("expected 3 object stores, got", n)
+	}
+	if _, err = repos.LookupBlob(mustOidFromString(t, "6c493ff740f9380390d5c9ddef4af18697ac9375")); err != nil {
+		t.Error(err)
+	}
+
+	repos, err = OpenRepositoryWithOptions(filepath.Join(dir, "c"), &RepositoryOptions{AlternateObjectDirectories: []string{"_testdata/testrepo.git/objects"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repos.Close()
+	if _, err = repos.LookupBlob(mustOidFromString(t, "6c493ff740f9380390d5c9ddef4af18697ac9375")); err != nil {
+		t.Error(err)
+	}
+}
+
 func TestRef(t *testing.T) {
 	repos, err := OpenRepository("_testdata/testrepo.git")
 	if err != nil {
@@ -344,6 +872,123 @@ func TestObjecttype(t *testing.T) {
 	}
 }
 
+func TestHeader(t *testing.T) {
+	testdata := []struct {
+		repository string
+		oid        string
+		ot         ObjectType
+		size       int64
+	}{
+		// tag object
+		{"_testdata/testrepo.git", "e6f8d0db36fd0e048979d115478abec90682bd78", ObjectTag, 150},
+		// deltified tree
+		{"_testdata/testrepo.git", "18c35a4f19f011195fd713ee1dea947e24e9b837", ObjectTree, 167},
+		// loose commit
+		{"_testdata/testrepo.git", "1337a1a1b0694887722f8bd0e541bd0f6567a471", ObjectCommit, 0},
+		// end of a long delta chain
+		{"_testdata/deltachain.git", "df17b922100f2ddf3301c869a92d9921a117fe92", ObjectBlob, 4921},
+		// REF_DELTA in a thin pack, base in the other pack
+		{"_testdata/refdelta.git", "4a7664aedd17b438b46ec999386c2c23767d5354", ObjectBlob, 10985},
+	}
+	for _, td := range testdata {
+		repos, err := OpenRepository(td.repository)
+		if err != nil {
+			t.Fatal(err)
+		}
+		oid := mustOidFromString(t, td.oid)
+		ot, size, err := repos.Header(oid)
+		if err != nil {
+			t.Fatal(td.oid, err)
+		}
+		rawot, rawsize, _, err := repos.getRawObject(oid)
+		if err != nil {
+			t.Fatal(td.oid, err)
+		}
+		if ot != td.ot || ot != rawot {
+			t.Errorf("%s: type %s, want %s", td.oid, ot, td.ot)
+		}
+		if (td.size != 0 && size != td.size) || size != rawsize {
+			t.Errorf("%s: size %d, want %d", td.oid, size, rawsize)
+		}
+		if ok, err := repos.HasObject(oid); !ok || err != nil {
+			t.Errorf("HasObject(%s) = %t, %v", td.oid, ok, err)
+		}
+		repos.Close()
+	}
+
+	repos, err := OpenRepository("_testdata/testrepo.git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oid := mustOidFromString(t, "0000000000000000000000000000000000000000")
+	if ok, err := repos.HasObject(oid); ok || err != nil {
+		t.Errorf("HasObject of a missing object = %t, %v", ok, err)
+	}
+	if _, _, err = repos.Header(oid); err != errObjNotFound {
+		t.Error("Header: expected object not found, got", err)
+	}
+	repos.Close()
+	if _, err := repos.HasObject(oid); err != ErrClosed {
+		t.Error("HasObject: expected ErrClosed, got", err)
+	}
+}
+
+func TestForEachObject(t *testing.T) {
+	testdata := []struct {
+		repository string
+		counts     map[ObjectType]int
+	}{
+		{"_testdata/testrepo.git", map[ObjectType]int{ObjectCommit: 12, ObjectTree: 25, ObjectBlob: 20, ObjectTag: 1}},
+		// own loose objects plus the objects of testrepo.git
+		{"_testdata/alternates.git", map[ObjectType]int{ObjectCommit: 13, ObjectTree: 26, ObjectBlob: 21, ObjectTag: 1}},
+		// objects in the multi-pack-index and in an uncovered pack
+		{"_testdata/midx.git", map[ObjectType]int{ObjectCommit: 6, ObjectTree: 6, ObjectBlob: 12}},
+	}
+	for _, td := range testdata {
+		repos, err := OpenRepository(td.repository)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts := make(map[ObjectType]int)
+		var last *Oid
+		err = repos.ForEachObject(func(oid *Oid, ot ObjectType) error {
+			if last != nil && bytes.Compare(last.Bytes[:], oid.Bytes[:]) >= 0 {
+				t.Errorf("%s: %s reported after %s", td.repository, oid, last)
+			}
+			last = oid
+			counts[ot]++
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, ot := range []ObjectType{ObjectCommit, ObjectTree, ObjectBlob, ObjectTag} {
+			if counts[ot] != td.counts[ot] {
+				t.Errorf("%s: %d objects of type %s, want %d", td.repository, counts[ot], ot, td.counts[ot])
+			}
+		}
+		repos.Close()
+	}
+
+	repos, err := OpenRepository("_testdata/testrepo.git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repos.Close()
+	stop := fmt.Errorf("stop")
+	n := 0
+	err = repos.ForEachObject(func(oid *Oid, ot ObjectType) error {
+		n++
+		if n == 3 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || n != 3 {
+		t.Errorf("expected iteration to stop after 3 objects, got %d objects and error %v", n, err)
+	}
+}
+
 func TestReadLenInPackFile(t *testing.T) {
 	buf := []byte{108, 215, 142}
 	length, advance := readLenInPackFile(buf)
@@ -0,0 +1,99 @@
+// Copyright (c) 2013 Patrick Gundlach, speedata (Berlin, Germany)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gogit
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"strconv"
+)
+
+// The HashAlgorithm of a repository is used for the object ids. The
+// default is SHA-1, repositories created with
+// `git init --object-format=sha256` use SHA-256.
+type HashAlgorithm int
+
+// The values are the hash ids used in multi-pack-index and commit-graph
+// files.
+const (
+	HashSHA1   HashAlgorithm = 1
+	HashSHA256 HashAlgorithm = 2
+)
+
+// Return the length of an object id in bytes.
+func (h HashAlgorithm) Size() int {
+	if h == HashSHA256 {
+		return sha256.Size
+	}
+	return sha1.Size
+}
+
+// Return the length of a hex-encoded object id.
+func (h HashAlgorithm) HexSize() int {
+	return 2 * h.Size()
+}
+
+// Return a new hash.Hash computing the hash.
+func (h HashAlgorithm) New() hash.Hash {
+	if h == HashSHA256 {
+		return sha256.New()
+	}
+	return sha1.New()
+}
+
+// Return the name of the hash algorithm as used in the git config
+// (extensions.objectFormat).
+func (h HashAlgorithm) String() string {
+	switch h {
+	case HashSHA1:
+		return "sha1"
+	case HashSHA256:
+		return "sha256"
+	default:
+		return ""
+	}
+}
+
+// Return the hash algorithm of the repository with the given config.
+func hashAlgorithmFromConfig(config map[string]string) (HashAlgorithm, error) {
+	format, ok := config["extensions.objectformat"]
+	// Extensions are only valid in repository format version 1
+	if !ok || config["core.repositoryformatversion"] != "1" {
+		return HashSHA1, nil
+	}
+	switch format {
+	case "sha1":
+		return HashSHA1, nil
+	case "sha256":
+		return HashSHA256, nil
+	}
+	return 0, fmt.Errorf("unsupported object format %q", format)
+}
+
+// Return the object id of an object with the given type and contents.
+func hashObject(h HashAlgorithm, ot ObjectType, data []byte) *Oid {
+	sum := h.New()
+	sum.Write([]byte(ot.headerName() + " " + strconv.Itoa(len(data)) + "\x00"))
+	sum.Write(data)
+	return &Oid{Bytes: sum.Sum(nil)}
+}
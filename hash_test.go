@@ -0,0 +1,163 @@
+package gogit
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gogit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config")
+	data := `# comment
+[core]
+	repositoryformatversion = 1
+	bare
+	; another comment
+[Extensions]
+	objectFormat = sha256 # trailing comment
+[remote "origin"]
+	url = "/some/path with spaces"
+	fetch = +refs/heads/*:refs/remotes/origin/*
+`
+	if err = ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := readConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"core.repositoryformatversion": "1",
+		"core.bare":                    "true",
+		"extensions.objectformat":      "sha256",
+		"remote.origin.url":            "/some/path with spaces",
+		"remote.origin.fetch":          "+refs/heads/*:refs/remotes/origin/*",
+	}
+	if len(config) != len(expected) {
+		t.Errorf("expected %d config entries, got %d: %v", len(expected), len(config), config)
+	}
+	for k, v := range expected {
+		if config[k] != v {
+			t.Errorf("%s = %q, want %q", k, config[k], v)
+		}
+	}
+	if h, err := hashAlgorithmFromConfig(config); h != HashSHA256 || err != nil {
+		t.Error("expected sha256, got", h, err)
+	}
+	config["core.repositoryformatversion"] = "0"
+	if h, err := hashAlgorithmFromConfig(config); h != HashSHA1 || err != nil {
+		t.Error("expected sha1 for repository format version 0, got", h, err)
+	}
+	config["core.repositoryformatversion"] = "1"
+	config["extensions.objectformat"] = "md5"
+	if _, err := hashAlgorithmFromConfig(config); err == nil {
+		t.Error("expected error for unknown object format")
+	}
+}
+
+func TestSHA256(t *testing.T) {
+	repos, err := OpenRepository("_testdata/sha256.git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repos.Close()
+	if h := repos.HashAlgorithm(); h != HashSHA256 {
+		t.Fatal("expected sha256 repository, got", h)
+	}
+
+	// The loose commit on top of three packed commits
+	ref, err := repos.LookupReference("refs/heads/master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref.Oid.String() != "bdb98265fdaee302ed6307781106f4276e30022ee87dd67edd9737768548ccb5" {
+		t.Fatal("wrong master", ref.Oid)
+	}
+	ci, err := repos.LookupCommit(ref.Oid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ci.Message() != "Loose commit\n" {
+		t.Errorf("wrong commit message %q", ci.Message())
+	}
+	if ci.TreeId().String() != "57cd430c97b8db29a1623fefada4dbb2dc30cb57ec28ab10c1e1e336ab64ed42" {
+		t.Error("wrong tree", ci.TreeId())
+	}
+	if ci.Generation() != 4 {
+		t.Error("expected generation 4 from the commit-graph, got", ci.Generation())
+	}
+	if ci.Tree.EntryCount() != 3 {
+		t.Fatal("expected 3 entries in the tree, got", ci.Tree.EntryCount())
+	}
+	te := ci.Tree.EntryByName("dir")
+	if te == nil || te.Type != ObjectTree || te.Id.String() != "488ff1f4339f6fe3349a5c1586a72a40aeec73b84758f2e06bb5f2e744c3fe66" {
+		t.Error("wrong tree entry dir", te)
+	}
+
+	// Walk back to the first commit through the packed commits
+	for i := 0; i < 3; i++ {
+		if ci = ci.Parent(0); ci == nil {
+			t.Fatal("cannot read parent")
+		}
+	}
+	if ci.Id().String() != "e92ece039a9ee7a6295de1335a9fff94851ce5dbd5aa91d69c4e8529ee3bffc3" || ci.ParentCount() != 0 {
+		t.Error("wrong root commit", ci.Id())
+	}
+
+	// file.txt of revision 2, stored as a delta
+	oid := mustOidFromString(t, "c80c4f12e08c8837c8b187de2826d7f38def8c7d1f9f3fbbe9387b45b3e73ef8")
+	ot, size, err := repos.Header(oid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ot != ObjectBlob || size != 1492 {
+		t.Errorf("wrong header %s %d", ot, size)
+	}
+	blob, err := repos.LookupBlob(oid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(blob.Contents(), []byte("\n399\n400\n")) {
+		t.Error("wrong contents of file.txt")
+	}
+
+	tag, err := repos.LookupTag(mustOidFromString(t, "a8aeb15e8d65a4df88301ef9e411aad69a6c497f9dc50d5b3c915a820910c824"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag.Name != "v1" || tag.TargetId.String() != "286a3c8b8da442566301ddbbf67bdec4f37deb3f6ddd3f5e667a8ba53a92b056" {
+		t.Error("wrong tag", tag.Name, tag.TargetId)
+	}
+
+	oid, err = repos.ResolvePrefix("c80c4f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(oid.String(), "c80c4f12e08c") || len(oid.Bytes) != 32 {
+		t.Error("wrong object", oid)
+	}
+
+	n := 0
+	if err = repos.ForEachObject(func(oid *Oid, ot ObjectType) error {
+		n++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n != 19 {
+		t.Error("expected 19 objects, got", n)
+	}
+
+	// A SHA-1 object id is never found in a SHA-256 repository
+	if ok, err := repos.HasObject(mustOidFromString(t, "c80c4f12e08c8837c8b187de2826d7f38def8c7d")); ok || err != nil {
+		t.Error("unexpected SHA-1 object", ok, err)
+	}
+}
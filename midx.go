@@ -0,0 +1,147 @@
+// Copyright (c) 2013 Patrick Gundlach, speedata (Berlin, Germany)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gogit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/speedata/mmap-go"
+)
+
+// A multi-pack-index file (objects/pack/multi-pack-index) is an index over
+// many pack files, so an object can be found with a single binary search
+// instead of one search per idx file.
+type midxFile struct {
+	path     string
+	hashSize int
+
+	// Names of the idx files covered by the multi-pack-index, the position
+	// in this list is the pack id used in the offset table.
+	packnames []string
+
+	fanoutTable [256]int64
+
+	// These tables are sub-slices of the whole file as an mmap
+	shaTable         []byte
+	offsetTable      []byte
+	largeOffsetTable []byte
+
+	data mmap.MMap
+}
+
+func readMidxFile(path string, hash HashAlgorithm) (*midxFile, error) {
+	midx := &midxFile{path: path, hashSize: hash.Size()}
+	var err error
+	midx.data, err = mapFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = midx.parse(); err != nil {
+		midx.close()
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return midx, nil
+}
+
+func (midx *midxFile) parse() error {
+	data := midx.data
+	// signature, version, oid version, number of chunks, number of base
+	// multi-pack-index files and number of packs
+	if len(data) < 12 || !bytes.HasPrefix(data, []byte("MIDX")) {
+		return errors.New("not a multi-pack-index file")
+	}
+	if data[4] != 1 {
+		return fmt.Errorf("unsupported multi-pack-index version %d", data[4])
+	}
+	if data[5] != byte(HashSHA1) && data[5] != byte(HashSHA256) {
+		return fmt.Errorf("unsupported object id version %d", data[5])
+	}
+	if hash := HashAlgorithm(data[5]); hash.Size() != midx.hashSize {
+		return fmt.Errorf("object format %s doesn't match the repository", hash)
+	}
+	numChunks := int(data[6])
+	numPacks := int(binary.BigEndian.Uint32(data[8:12]))
+
+	chunks, err := readChunkTable(data, 12, numChunks)
+	if err != nil {
+		return err
+	}
+	for _, id := range []uint32{chunkPackNames, chunkOidFanout, chunkOidLookup, chunkObjectOffset} {
+		if chunks[id] == nil {
+			return fmt.Errorf("required chunk %x missing", id)
+		}
+	}
+
+	names := chunks[chunkPackNames]
+	for i := 0; i < numPacks; i++ {
+		zero := bytes.IndexByte(names, 0)
+		if zero < 0 {
+			return errors.New("pack names truncated")
+		}
+		midx.packnames = append(midx.packnames, string(names[:zero]))
+		names = names[zero+1:]
+	}
+
+	if err = readFanoutChunk(chunks[chunkOidFanout], &midx.fanoutTable); err != nil {
+		return err
+	}
+	numObjects := midx.fanoutTable[255]
+	midx.shaTable = chunks[chunkOidLookup]
+	midx.offsetTable = chunks[chunkObjectOffset]
+	midx.largeOffsetTable = chunks[chunkLargeOffset]
+	if int64(len(midx.shaTable)) != numObjects*int64(midx.hashSize) || int64(len(midx.offsetTable)) != numObjects*8 {
+		return errors.New("wrong size of oid lookup or object offset chunk")
+	}
+	return nil
+}
+
+// Return the pack id and the offset in the pack file of the object.
+func (midx *midxFile) find(target []byte) (packid int, offset uint64, found bool) {
+	n, found := searchSHA(&midx.fanoutTable, midx.shaTable, midx.hashSize, target)
+	if !found {
+		return 0, 0, false
+	}
+	pos := n * 8
+	packid = int(binary.BigEndian.Uint32(midx.offsetTable[pos : pos+4]))
+	offset = uint64(binary.BigEndian.Uint32(midx.offsetTable[pos+4 : pos+8]))
+	// If msb is set, offset is actually an index into the large offset table.
+	if offset&0x80000000 == 0x80000000 {
+		pos := int(offset&0x7FFFFFFF) * 8
+		if pos+8 > len(midx.largeOffsetTable) {
+			return 0, 0, false
+		}
+		offset = binary.BigEndian.Uint64(midx.largeOffsetTable[pos : pos+8])
+	}
+	return packid, offset, true
+}
+
+func (midx *midxFile) close() error {
+	if midx.data == nil {
+		return nil
+	}
+	err := midx.data.Unmap()
+	midx.data = nil
+	midx.shaTable, midx.offsetTable, midx.largeOffsetTable = nil, nil, nil
+	return err
+}
@@ -0,0 +1,137 @@
+package gogit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMidx(t *testing.T) {
+	midx, err := readMidxFile("_testdata/midx.git/objects/pack/multi-pack-index", HashSHA1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer midx.close()
+	if n := len(midx.packnames); n != 3 {
+		t.Fatal("expected 3 packs in the multi-pack-index, got", n)
+	}
+	// file.txt of revision 2 is in pack-cd9157...
+	packid, offset, found := midx.find(mustOidFromString(t, "b371abcdc3aa99c0f688e19811bfce76cefff2e4").Bytes)
+	if !found {
+		t.Fatal("object not found in multi-pack-index")
+	}
+	if name := midx.packnames[packid]; name != "pack-cd9157a8b1c979f2b3c6e5de0897bb32060d70aa.idx" {
+		t.Error("wrong pack", name)
+	}
+	idx, err := readIdxFile("_testdata/midx.git/objects/pack/pack-cd9157a8b1c979f2b3c6e5de0897bb32060d70aa.idx", HashSHA1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.close()
+	if want := idx.offsetForSHA(mustOidFromString(t, "b371abcdc3aa99c0f688e19811bfce76cefff2e4").Bytes); offset != want {
+		t.Errorf("offset = %d want %d", offset, want)
+	}
+	// in pack-65c9c6..., which is not part of the multi-pack-index
+	if _, _, found = midx.find(mustOidFromString(t, "4a7664aedd17b438b46ec999386c2c23767d5354").Bytes); found {
+		t.Error("object should not be in the multi-pack-index")
+	}
+
+	repos, err := OpenRepository("_testdata/midx.git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repos.Close()
+	store := repos.stores[0]
+	if n := len(store.covered); n != 3 {
+		t.Error("expected 3 pack files covered by the multi-pack-index, got", n)
+	}
+	tests := []struct {
+		oid  string
+		pack string
+	}{
+		{oid: "4dccfcad5b24135bf414c25c6135062a6d52f2b5", pack: "pack-b48e85575b47240bce0c4320b98b7e74e574c9e7.pack"},
+		{oid: "e6f9e488b8e28cdcd8d4ee281f9d5cc908c1005c", pack: "pack-2bc68b4830a7052cece4534991318132e89f4d71.pack"},
+		{oid: "4a7664aedd17b438b46ec999386c2c23767d5354", pack: "pack-65c9c66edf1cd9de6e978c6844d572231653573a.pack"},
+	}
+	for _, test := range tests {
+		oid := mustOidFromString(t, test.oid)
+		_, pack, _, found := store.find(oid)
+		if !found {
+			t.Errorf("%s not found", test.oid)
+			continue
+		}
+		if name := filepath.Base(pack.packpath); name != test.pack {
+			t.Errorf("%s found in %s, want %s", test.oid, name, test.pack)
+		}
+		if _, err = repos.LookupBlob(oid); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestMidxUnsupportedVersion(t *testing.T) {
+	dir := copyRepository(t, "_testdata/midx.git")
+	defer os.RemoveAll(dir)
+	midxpath := filepath.Join(dir, "objects", "pack", "multi-pack-index")
+	data, err := ioutil.ReadFile(midxpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// version byte
+	data[4] = 2
+	if err = ioutil.WriteFile(midxpath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	repos, err := OpenRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repos.Close()
+	store := repos.stores[0]
+	if store.midx != nil || store.midxErr == nil {
+		t.Error("unreadable multi-pack-index should not be used")
+	}
+	for _, sha1 := range []string{"4dccfcad5b24135bf414c25c6135062a6d52f2b5", "e6f9e488b8e28cdcd8d4ee281f9d5cc908c1005c", "4a7664aedd17b438b46ec999386c2c23767d5354"} {
+		if _, err = repos.LookupBlob(mustOidFromString(t, sha1)); err != nil {
+			t.Error(err)
+		}
+	}
+	res, err := repos.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Problems) != 1 || res.Problems[0].Kind != VerifyUnreadable || res.Problems[0].Path != midxpath {
+		t.Errorf("unreadable multi-pack-index not reported: %v", res.Problems)
+	}
+}
+
+// The multi-pack-index is only read again if it has changed.
+func TestMidxRescan(t *testing.T) {
+	dir := copyRepository(t, "_testdata/midx.git")
+	defer os.RemoveAll(dir)
+	repos, err := OpenRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repos.Close()
+	store := repos.stores[0]
+	midx := store.midx
+	if midx == nil {
+		t.Fatal("multi-pack-index not loaded")
+	}
+	store.rescanPacks()
+	if store.midx != midx || len(store.covered) != 3 {
+		t.Error("unchanged multi-pack-index read again")
+	}
+	later := store.midxInfo.ModTime().Add(time.Second)
+	if err = os.Chtimes(midx.path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	store.rescanPacks()
+	if store.midx == midx || store.midx == nil || len(store.covered) != 3 {
+		t.Error("changed multi-pack-index not read again")
+	}
+}
@@ -0,0 +1,320 @@
+// Copyright (c) 2013 Patrick Gundlach, speedata (Berlin, Germany)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gogit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Alternates of alternates are followed up to this depth (same as git).
+const maxAlternateDepth = 5
+
+// An objectStore is a directory with loose objects and pack files. Besides
+// the objects directory of the repository itself, there is an object store
+// for every alternate object directory.
+type objectStore struct {
+	dir        string
+	hash       HashAlgorithm
+	indexfiles []*idxFile
+
+	// The multi-pack-index file (if any) and the pack files it covers by
+	// pack id. Covered pack files are not searched separately.
+	midx      *midxFile
+	midxPacks []*idxFile
+	covered   map[*idxFile]bool
+	// The multi-pack-index file that has been read, to detect changes
+	midxInfo os.FileInfo
+
+	// idx files and the multi-pack-index are skipped if they can't be
+	// read (like git does), the errors are reported by Verify.
+	badPacks map[string]error
+	midxErr  error
+}
+
+// Open the object store in dir and read the idx files of all pack files.
+// A missing directory is an empty object store.
+func openObjectStore(dir string, hash HashAlgorithm) (*objectStore, error) {
+	store := &objectStore{dir: dir, hash: hash}
+	indexfiles, err := filepath.Glob(filepath.Join(dir, "pack", "*.idx"))
+	if err != nil {
+		return nil, err
+	}
+	store.indexfiles = make([]*idxFile, 0, len(indexfiles))
+	store.badPacks = make(map[string]error)
+	for _, indexfile := range indexfiles {
+		idx, err := readIdxFile(indexfile, store.hash)
+		if err != nil {
+			store.badPacks[indexfile] = err
+			continue
+		}
+		store.indexfiles = append(store.indexfiles, idx)
+	}
+	store.loadMidx()
+	return store, nil
+}
+
+// Read the multi-pack-index file of the store, if there is one and it has
+// changed since it has been read last, and assign the idx files to the
+// packs it covers. The multi-pack-index only speeds up lookups. If it
+// can't be read, the error is kept in midxErr and all pack files are
+// searched separately.
+func (store *objectStore) loadMidx() {
+	path := filepath.Join(store.dir, "pack", "multi-pack-index")
+	fi, err := os.Stat(path)
+	old := store.midxInfo
+	if fi == nil || old == nil || fi.Size() != old.Size() || !fi.ModTime().Equal(old.ModTime()) {
+		if store.midx != nil {
+			store.midx.close()
+		}
+		store.midx, store.midxInfo, store.midxErr = nil, fi, nil
+		switch {
+		case err == nil:
+			store.midx, store.midxErr = readMidxFile(path, store.hash)
+		case !os.IsNotExist(err):
+			store.midxErr = err
+		}
+	}
+	store.midxPacks, store.covered = nil, nil
+	if store.midx == nil {
+		return
+	}
+	midx := store.midx
+	byname := make(map[string]*idxFile, len(store.indexfiles))
+	for _, idx := range store.indexfiles {
+		byname[filepath.Base(idx.path)] = idx
+	}
+	store.midxPacks = make([]*idxFile, len(midx.packnames))
+	store.covered = make(map[*idxFile]bool, len(midx.packnames))
+	for i, name := range midx.packnames {
+		// Older versions of git store the name of the pack file
+		if strings.HasSuffix(name, ".pack") {
+			name = strings.TrimSuffix(name, ".pack") + ".idx"
+		}
+		if idx := byname[name]; idx != nil {
+			store.midxPacks[i] = idx
+			store.covered[idx] = true
+		}
+	}
+}
+
+// Find the object in the object store. If it is a loose object, return the
+// path to the object file, otherwise the pack file and the offset in the
+// pack file. found is false if the object is not in this store.
+func (store *objectStore) find(oid *Oid) (objpath string, pack *idxFile, offset uint64, found bool) {
+	objpath = filepathFromSHA1(store.dir, oid.String())
+	if _, err := os.Stat(objpath); !os.IsNotExist(err) {
+		return objpath, nil, 0, true
+	}
+	if store.midx != nil {
+		if packid, offset, ok := store.midx.find(oid.Bytes); ok && packid < len(store.midxPacks) && store.midxPacks[packid] != nil {
+			return "", store.midxPacks[packid], offset, true
+		}
+	}
+	for _, indexfile := range store.indexfiles {
+		if store.covered[indexfile] {
+			continue
+		}
+		if offset = indexfile.offsetForSHA(oid.Bytes); offset != 0 {
+			return "", indexfile, offset, true
+		}
+	}
+	return "", nil, 0, false
+}
+
+// Call f with the id of every object in the store: the loose objects,
+// then the objects in the multi-pack-index and in the pack files it
+// doesn't cover. An object stored more than once is reported more than
+// once.
+func (store *objectStore) forEachOid(f func(sha []byte)) error {
+	dirs, err := ioutil.ReadDir(store.dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() || len(dir.Name()) != 2 {
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(store.dir, dir.Name()))
+		if err != nil {
+			return err
+		}
+		for _, fi := range files {
+			if sha, err := hex.DecodeString(dir.Name() + fi.Name()); err == nil && len(sha) == store.hash.Size() {
+				f(sha)
+			}
+		}
+	}
+	size := store.hash.Size()
+	if store.midx != nil {
+		for pos := 0; pos+size <= len(store.midx.shaTable); pos += size {
+			f(store.midx.shaTable[pos : pos+size])
+		}
+	}
+	for _, idx := range store.indexfiles {
+		if store.covered[idx] {
+			continue
+		}
+		for pos := 0; pos+size <= len(idx.shaTable); pos += size {
+			f(idx.shaTable[pos : pos+size])
+		}
+	}
+	return nil
+}
+
+// Read the pack directory and update the list of pack files: open new
+// ones and close the ones that have been removed. Return true if the list
+// has changed.
+func (store *objectStore) rescanPacks() bool {
+	indexfiles, err := filepath.Glob(filepath.Join(store.dir, "pack", "*.idx"))
+	if err != nil {
+		return false
+	}
+	found := make(map[string]bool, len(indexfiles))
+	for _, indexfile := range indexfiles {
+		found[indexfile] = true
+	}
+
+	changed := false
+	known := make(map[string]bool, len(store.indexfiles))
+	packs := make([]*idxFile, 0, len(indexfiles))
+	for _, idx := range store.indexfiles {
+		if found[idx.path] {
+			packs = append(packs, idx)
+			known[idx.path] = true
+		} else {
+			idx.close()
+			changed = true
+		}
+	}
+	badPacks := make(map[string]error)
+	for _, indexfile := range indexfiles {
+		if known[indexfile] {
+			continue
+		}
+		idx, err := readIdxFile(indexfile, store.hash)
+		if err != nil {
+			// Might be a pack that is being written right now, try again
+			// with the next scan.
+			badPacks[indexfile] = err
+			continue
+		}
+		packs = append(packs, idx)
+		changed = true
+	}
+	store.indexfiles = packs
+	store.badPacks = badPacks
+	// The multi-pack-index might have been rewritten as well
+	store.loadMidx()
+	return changed
+}
+
+func (store *objectStore) close() error {
+	var err error
+	if store.midx != nil {
+		err = store.midx.close()
+	}
+	for _, idx := range store.indexfiles {
+		if e := idx.close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Return the object directories listed in info/alternates of the object
+// store in dir. Relative paths are relative to dir.
+func readAlternates(dir string) ([]string, error) {
+	f, err := os.Open(filepath.Join(dir, "info", "alternates"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var alternates []string
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		line := bytes.TrimSpace(scan.Bytes())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		alternate := string(line)
+		if !filepath.IsAbs(alternate) {
+			alternate = filepath.Join(dir, alternate)
+		}
+		alternates = append(alternates, filepath.Clean(alternate))
+	}
+	return alternates, scan.Err()
+}
+
+// Open the object store in dir and add it to the repository, then do the
+// same for its alternates. Object directories which are already part of
+// the repository (cycles) or which don't exist are skipped.
+func (repos *Repository) addObjectStore(dir string, depth int, seen map[string]bool) error {
+	if realdir, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = realdir
+	} else if depth > 0 {
+		// git ignores missing alternates as well
+		return nil
+	}
+	if seen[dir] {
+		return nil
+	}
+	seen[dir] = true
+	store, err := openObjectStore(dir, repos.hash)
+	if err != nil {
+		return err
+	}
+	repos.stores = append(repos.stores, store)
+	if depth >= maxAlternateDepth {
+		return nil
+	}
+	alternates, err := readAlternates(dir)
+	if err != nil {
+		return err
+	}
+	for _, alternate := range alternates {
+		if err = repos.addObjectStore(alternate, depth+1, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Find the object in the object stores of the repository, see
+// objectStore.find. Return errObjNotFound if the object doesn't exist.
+// The caller must hold the read lock.
+func (repos *Repository) findObject(oid *Oid) (objpath string, pack *idxFile, offset uint64, err error) {
+	for _, store := range repos.stores {
+		var found bool
+		if objpath, pack, offset, found = store.find(oid); found {
+			return
+		}
+	}
+	return "", nil, 0, errObjNotFound
+}
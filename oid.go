@@ -1,56 +1,65 @@
 package gogit
 
 import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
 )
 
-// Oid is the representation of a sha1-string
+// Oid is the representation of an object id: a SHA-1 (20 bytes) or, in
+// repositories with the sha256 object format, a SHA-256 (32 bytes).
 type Oid struct {
-	Bytes SHA1
+	Bytes []byte
 }
 
-// Create a new Oid from a Sha1 string of length 40.
+// Create a new Oid from a hex string of length 40 (SHA-1) or 64 (SHA-256).
 // In performance-sensitive paths, use NewOidFromByteString.
 func NewOidFromString(sha1 string) (*Oid, error) {
 	return NewOidFromByteString([]byte(sha1))
 }
 
-// Create a new Oid from a 20 byte slice.
+// Create a new Oid from a 20 (SHA-1) or 32 (SHA-256) byte slice.
 func NewOid(b []byte) (*Oid, error) {
-	if len(b) != 20 {
-		return nil, errors.New("Length must be 20")
+	if len(b) != sha1.Size && len(b) != sha256.Size {
+		return nil, errors.New("Length must be 20 or 32")
 	}
-	var o Oid
-	copy(o.Bytes[:], b)
-	return &o, nil
+	o := &Oid{Bytes: make([]byte, len(b))}
+	copy(o.Bytes, b)
+	return o, nil
 }
 
-// Create a new Oid from a 40 byte hex-encoded slice.
+// Create a new Oid from a 40 or 64 byte hex-encoded slice.
 func NewOidFromByteString(b []byte) (*Oid, error) {
-	if len(b) != 40 {
-		return nil, fmt.Errorf("bad hex-encoded sha1 length %d want 40", len(b))
+	if len(b) != 2*sha1.Size && len(b) != 2*sha256.Size {
+		return nil, fmt.Errorf("bad hex-encoded object id length %d want 40 or 64", len(b))
 	}
-	var o Oid
-	_, err := hex.Decode(o.Bytes[:], b)
+	o := &Oid{Bytes: make([]byte, len(b)/2)}
+	_, err := hex.Decode(o.Bytes, b)
 	if err != nil {
 		return nil, err
 	}
-	return &o, nil
+	return o, nil
 }
 
-// Create a new Oid from a 20 byte array
+// Create a new (SHA-1) Oid from a 20 byte array
 func NewOidFromArray(a SHA1) *Oid {
-	return &Oid{a}
+	return &Oid{Bytes: append([]byte(nil), a[:]...)}
 }
 
 // Return string (hex) representation of the Oid
 func (o *Oid) String() string {
-	return hex.EncodeToString(o.Bytes[:])
+	return hex.EncodeToString(o.Bytes)
 }
 
-// Equal reports whether o and oid2 have the same sha1.
+// Equal reports whether o and oid2 are the same object id.
 func (o *Oid) Equal(oid2 *Oid) bool {
-	return o.Bytes == oid2.Bytes
+	return bytes.Equal(o.Bytes, oid2.Bytes)
+}
+
+// The object id as a string of bytes, for use as a map key.
+func (o *Oid) key() string {
+	return string(o.Bytes)
 }
@@ -0,0 +1,448 @@
+// Copyright (c) 2013 Patrick Gundlach, speedata (Berlin, Germany)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gogit
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Options for writing pack files. The zero value gives the defaults.
+type PackOptions struct {
+	// The number of preceding objects that are tried as delta base for
+	// each object. 0 means the default (10), a negative value disables
+	// delta compression.
+	Window int
+	// The maximum length of a delta chain. 0 means the default (50).
+	Depth int
+}
+
+const (
+	defaultPackWindow = 10
+	defaultPackDepth  = 50
+
+	// Objects smaller than this are not deltified
+	minDeltaSize = 50
+	// Offsets in version 2 idx files larger than this go into the table
+	// of 64 bit offsets.
+	maxIdxOffset32 = 0x7fffffff
+)
+
+// An object to be written to a pack file.
+type packObject struct {
+	oid    *Oid
+	ot     ObjectType
+	length int64
+	data   []byte // only while the object is in the delta window
+	depth  int    // length of the delta chain, 0 if not deltified
+	offset uint64
+	crc    uint32
+}
+
+// Write the objects with the given ids to a version 2 pack file and the
+// corresponding version 2 idx file to idx. Objects are stored deltified
+// (OFS_DELTA) against similar objects of the same type when this saves
+// space. The pack is self-contained, all delta bases are in the pack.
+// Return the checksum of the pack, git names the files
+// pack-<checksum in hex>.pack and .idx.
+func (repos *Repository) WritePack(pack, idx io.Writer, oids []*Oid, opts *PackOptions) ([]byte, error) {
+	return repos.writePack(pack, idx, oids, opts, maxIdxOffset32)
+}
+
+// Write a pack file with the given objects and its idx file to the
+// directory dir (usually objects/pack) and return the path of the pack
+// file. The files are first written to temporary files and then renamed.
+func (repos *Repository) WritePackFiles(dir string, oids []*Oid, opts *PackOptions) (string, error) {
+	packtmp, err := ioutil.TempFile(dir, "tmp_pack_")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(packtmp.Name())
+	defer packtmp.Close()
+	idxtmp, err := ioutil.TempFile(dir, "tmp_idx_")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(idxtmp.Name())
+	defer idxtmp.Close()
+
+	checksum, err := repos.WritePack(packtmp, idxtmp, oids, opts)
+	if err != nil {
+		return "", err
+	}
+	for _, f := range []*os.File{packtmp, idxtmp} {
+		if err = f.Chmod(0444); err != nil {
+			return "", err
+		}
+		if err = f.Close(); err != nil {
+			return "", err
+		}
+	}
+	base := filepath.Join(dir, "pack-"+(&Oid{Bytes: checksum}).String())
+	// The pack file has to be in place before the idx file, readers
+	// look for the idx files.
+	if err = os.Rename(packtmp.Name(), base+".pack"); err != nil {
+		return "", err
+	}
+	if err = os.Rename(idxtmp.Name(), base+".idx"); err != nil {
+		return "", err
+	}
+	return base + ".pack", nil
+}
+
+// Same as WritePack, offsets larger than maxOffset32 are written to the
+// table of 64 bit offsets in the idx file.
+func (repos *Repository) writePack(pack, idx io.Writer, oids []*Oid, opts *PackOptions, maxOffset32 uint64) ([]byte, error) {
+	window, depth := defaultPackWindow, defaultPackDepth
+	if opts != nil {
+		if opts.Window != 0 {
+			window = opts.Window
+		}
+		if opts.Depth > 0 {
+			depth = opts.Depth
+		}
+	}
+
+	// Git sorts the objects by type and size (largest first), so that
+	// similar objects are close to each other and deltas mostly remove
+	// data.
+	seen := make(map[string]bool)
+	var objects []*packObject
+	for _, oid := range oids {
+		if err := repos.checkOidSize(oid); err != nil {
+			return nil, err
+		}
+		if seen[oid.key()] {
+			continue
+		}
+		seen[oid.key()] = true
+		ot, length, err := repos.Header(oid)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, &packObject{oid: oid, ot: ot, length: length})
+	}
+	sort.SliceStable(objects, func(i, j int) bool {
+		if objects[i].ot != objects[j].ot {
+			return objects[i].ot < objects[j].ot
+		}
+		return objects[i].length > objects[j].length
+	})
+
+	sum := repos.hash.New()
+	pw := &packWriter{w: io.MultiWriter(pack, sum)}
+	var header [12]byte
+	copy(header[:], "PACK")
+	binary.BigEndian.PutUint32(header[4:], 2)
+	binary.BigEndian.PutUint32(header[8:], uint32(len(objects)))
+	if err := pw.write(header[:]); err != nil {
+		return nil, err
+	}
+
+	for i, obj := range objects {
+		_, _, data, err := repos.getRawObject(obj.oid)
+		if err != nil {
+			return nil, err
+		}
+		obj.data = data
+
+		// Try the objects in the window as delta base and keep the
+		// smallest delta that is considerably smaller than the object.
+		var base *packObject
+		var delta []byte
+		if window > 0 && len(data) >= minDeltaSize {
+			maxsize := len(data)/2 - 20
+			for j := i - 1; j >= 0 && j >= i-window; j-- {
+				cand := objects[j]
+				if cand.ot != obj.ot || cand.depth >= depth || len(cand.data) < minDeltaSize {
+					continue
+				}
+				if d := createDelta(cand.data, data, maxsize); d != nil {
+					base, delta, maxsize = cand, d, len(d)-1
+				}
+			}
+		}
+		if i >= window && window > 0 {
+			// Falls out of the window
+			objects[i-window].data = nil
+		}
+		obj.offset = pw.offset
+		if base != nil {
+			obj.depth = base.depth + 1
+			err = pw.writeEntry(objectOfsDelta, int64(len(delta)), obj.offset-base.offset, delta)
+		} else {
+			err = pw.writeEntry(obj.ot, int64(len(data)), 0, data)
+		}
+		if err != nil {
+			return nil, err
+		}
+		obj.crc = pw.crc
+		if window <= 0 {
+			obj.data = nil
+		}
+	}
+	checksum := sum.Sum(nil)
+	if _, err := pack.Write(checksum); err != nil {
+		return nil, err
+	}
+	if err := writeIdxFile(idx, repos.hash, objects, checksum, maxOffset32); err != nil {
+		return nil, err
+	}
+	return checksum, nil
+}
+
+// A packWriter writes pack entries and keeps track of the position in the
+// pack file.
+type packWriter struct {
+	w      io.Writer
+	offset uint64
+	crc    uint32 // CRC32 of the last entry
+	buf    bytes.Buffer
+	z      *zlib.Writer
+}
+
+func (pw *packWriter) write(b []byte) error {
+	n, err := pw.w.Write(b)
+	pw.offset += uint64(n)
+	return err
+}
+
+// Write a pack entry of type ot. length is the length of the inflated
+// data. For OFS_DELTA entries, baseDistance is the distance to the
+// offset of the base object.
+func (pw *packWriter) writeEntry(ot ObjectType, length int64, baseDistance uint64, data []byte) error {
+	pw.buf.Reset()
+	// type and length: 4 bits of the length in the first byte, then 7
+	// bits per byte
+	c := byte(ot) | byte(length&0x0f)
+	length >>= 4
+	for length > 0 {
+		pw.buf.WriteByte(c | 0x80)
+		c = byte(length & 0x7f)
+		length >>= 7
+	}
+	pw.buf.WriteByte(c)
+	if ot == objectOfsDelta {
+		// big endian, 7 bits per byte, and each continuation adds one
+		// (see readPackEntry)
+		var ofs [10]byte
+		pos := len(ofs) - 1
+		ofs[pos] = byte(baseDistance & 0x7f)
+		for baseDistance >>= 7; baseDistance > 0; baseDistance >>= 7 {
+			baseDistance--
+			pos--
+			ofs[pos] = 0x80 | byte(baseDistance&0x7f)
+		}
+		pw.buf.Write(ofs[pos:])
+	}
+	if pw.z == nil {
+		pw.z = zlib.NewWriter(&pw.buf)
+	} else {
+		pw.z.Reset(&pw.buf)
+	}
+	if _, err := pw.z.Write(data); err != nil {
+		return err
+	}
+	if err := pw.z.Close(); err != nil {
+		return err
+	}
+	pw.crc = crc32.ChecksumIEEE(pw.buf.Bytes())
+	return pw.write(pw.buf.Bytes())
+}
+
+// Write a version 2 idx file for the objects of a pack file with the
+// given checksum. Offsets larger than maxOffset32 go into the table of 64
+// bit offsets.
+func writeIdxFile(w io.Writer, hash HashAlgorithm, objects []*packObject, packChecksum []byte, maxOffset32 uint64) error {
+	sorted := make([]*packObject, len(objects))
+	copy(sorted, objects)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].oid.Bytes, sorted[j].oid.Bytes) < 0
+	})
+	sum := hash.New()
+	iw := &idxWriter{w: io.MultiWriter(w, sum)}
+	iw.write(idxSignature[:])
+	iw.uint32(2)
+
+	var fanout [256]uint32
+	for _, obj := range sorted {
+		fanout[obj.oid.Bytes[0]]++
+	}
+	var count uint32
+	for _, n := range fanout {
+		count += n
+		iw.uint32(count)
+	}
+	for _, obj := range sorted {
+		iw.write(obj.oid.Bytes)
+	}
+	for _, obj := range sorted {
+		iw.uint32(obj.crc)
+	}
+	var largeOffsets []uint64
+	for _, obj := range sorted {
+		if obj.offset > maxOffset32 {
+			iw.uint32(0x80000000 | uint32(len(largeOffsets)))
+			largeOffsets = append(largeOffsets, obj.offset)
+		} else {
+			iw.uint32(uint32(obj.offset))
+		}
+	}
+	for _, offset := range largeOffsets {
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], offset)
+		iw.write(b[:])
+	}
+	iw.write(packChecksum)
+	if iw.err != nil {
+		return iw.err
+	}
+	_, err := w.Write(sum.Sum(nil))
+	return err
+}
+
+// An idxWriter remembers the first write error.
+type idxWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (iw *idxWriter) write(b []byte) {
+	if iw.err == nil {
+		_, iw.err = iw.w.Write(b)
+	}
+}
+
+func (iw *idxWriter) uint32(n uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], n)
+	iw.write(b[:])
+}
+
+// The length of the blocks of the base object that are indexed by
+// createDelta.
+const deltaBlockSize = 16
+
+// Return a delta that creates target from base (see applyDelta) or nil if
+// the delta would be larger than maxsize bytes.
+func createDelta(base, target []byte, maxsize int) []byte {
+	if maxsize <= 0 {
+		return nil
+	}
+	// Index the blocks of the base object, the first occurrence of a
+	// block wins.
+	index := make(map[string]int, len(base)/deltaBlockSize)
+	for pos := 0; pos+deltaBlockSize <= len(base); pos += deltaBlockSize {
+		key := string(base[pos : pos+deltaBlockSize])
+		if _, ok := index[key]; !ok {
+			index[key] = pos
+		}
+	}
+
+	var delta bytes.Buffer
+	writeDeltaLength(&delta, len(base))
+	writeDeltaLength(&delta, len(target))
+	insertStart := 0
+	pos := 0
+	for pos+deltaBlockSize <= len(target) && delta.Len() <= maxsize {
+		basepos, ok := index[string(target[pos:pos+deltaBlockSize])]
+		if !ok {
+			pos++
+			continue
+		}
+		// Extend the match backwards into the pending insert and
+		// forwards as far as possible.
+		start, bstart := pos, basepos
+		for start > insertStart && bstart > 0 && target[start-1] == base[bstart-1] {
+			start--
+			bstart--
+		}
+		end, bend := pos+deltaBlockSize, basepos+deltaBlockSize
+		for end < len(target) && bend < len(base) && target[end] == base[bend] {
+			end++
+			bend++
+		}
+		writeDeltaInsert(&delta, target[insertStart:start])
+		writeDeltaCopy(&delta, bstart, end-start)
+		pos, insertStart = end, end
+	}
+	writeDeltaInsert(&delta, target[insertStart:])
+	if delta.Len() > maxsize {
+		return nil
+	}
+	return delta.Bytes()
+}
+
+// Write n as little endian base 128 number (see
+// readLittleEndianBase128Number).
+func writeDeltaLength(buf *bytes.Buffer, n int) {
+	for n >= 0x80 {
+		buf.WriteByte(byte(n) | 0x80)
+		n >>= 7
+	}
+	buf.WriteByte(byte(n))
+}
+
+// Write insert instructions for data, at most 127 bytes each.
+func writeDeltaInsert(buf *bytes.Buffer, data []byte) {
+	for len(data) > 0 {
+		n := len(data)
+		if n > 0x7f {
+			n = 0x7f
+		}
+		buf.WriteByte(byte(n))
+		buf.Write(data[:n])
+		data = data[n:]
+	}
+}
+
+// Write copy instructions for length bytes at offset of the base object.
+// One instruction copies at most 0xffffff bytes, only the non-zero bytes
+// of offset and length are stored.
+func writeDeltaCopy(buf *bytes.Buffer, offset, length int) {
+	for length > 0 {
+		n := length
+		if n > 0xffffff {
+			n = 0xffffff
+		}
+		var args [7]byte
+		opcode := byte(0x80)
+		pos := 0
+		for i, v := range [7]byte{byte(offset), byte(offset >> 8), byte(offset >> 16), byte(offset >> 24), byte(n), byte(n >> 8), byte(n >> 16)} {
+			if v != 0 {
+				opcode |= 1 << uint(i)
+				args[pos] = v
+				pos++
+			}
+		}
+		buf.WriteByte(opcode)
+		buf.Write(args[:pos])
+		offset += n
+		length -= n
+	}
+}
@@ -0,0 +1,153 @@
+package gogit
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Return the ids of all objects in the repository.
+func allObjects(t *testing.T, repos *Repository) []*Oid {
+	var oids []*Oid
+	err := repos.ForEachObject(func(oid *Oid, ot ObjectType) error {
+		oids = append(oids, oid)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return oids
+}
+
+func TestWritePack(t *testing.T) {
+	for _, name := range []string{"testrepo.git", "deltachain.git", "sha256.git"} {
+		repos, err := OpenRepository(filepath.Join("_testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		oids := allObjects(t, repos)
+		for _, maxOffset32 := range []uint64{maxIdxOffset32, 0} {
+			dir, err := ioutil.TempDir("", "gogit")
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkWrittenPack(t, repos, oids, dir, maxOffset32)
+			os.RemoveAll(dir)
+		}
+		repos.Close()
+	}
+}
+
+// Write a pack with the objects to dir, read it back and compare the
+// objects with the ones in repos.
+func checkWrittenPack(t *testing.T, repos *Repository, oids []*Oid, dir string, maxOffset32 uint64) {
+	var pack, idx bytes.Buffer
+	checksum, err := repos.writePack(&pack, &idx, oids, nil, maxOffset32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := filepath.Join(dir, "pack-"+(&Oid{Bytes: checksum}).String())
+	if err = ioutil.WriteFile(base+".pack", pack.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(base+".idx", idx.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	packed, err := readIdxFile(base+".idx", repos.hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer packed.close()
+	if n := len(packed.shaTable) / repos.hash.Size(); n != len(oids) {
+		t.Errorf("%d objects in pack, want %d", n, len(oids))
+	}
+	if maxOffset32 == 0 && len(packed.offset8Table) != 8*len(oids) {
+		t.Errorf("64 bit offset table has %d bytes", len(packed.offset8Table))
+	}
+	deltas := 0
+	reader := &Repository{hash: repos.hash}
+	for _, oid := range oids {
+		offset := packed.offsetForSHA(oid.Bytes)
+		if offset == 0 {
+			t.Fatalf("%s not in pack", oid)
+		}
+		ot, _, data, err := reader.readObjectBytes(packed, offset, false)
+		if err != nil {
+			t.Fatalf("%s: %s", oid, err)
+		}
+		if !hashObject(repos.hash, ot, data).Equal(oid) {
+			t.Errorf("%s: wrong contents", oid)
+		}
+		if entry, _ := readPackEntry(packed.packMmap, int64(offset), repos.hash.Size()); entry.ot == objectOfsDelta {
+			deltas++
+		}
+	}
+	if deltas == 0 {
+		t.Error("no deltas in pack")
+	}
+}
+
+func TestWritePackFiles(t *testing.T) {
+	src, err := OpenRepository("_testdata/deltachain.git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	oids := allObjects(t, src)
+
+	// A repository with only the new pack file
+	dir := copyRepository(t, "_testdata/deltachain.git")
+	defer os.RemoveAll(dir)
+	packdir := filepath.Join(dir, "objects", "pack")
+	if err = os.RemoveAll(packdir); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Mkdir(packdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	packpath, err := src.WritePackFiles(packdir, oids, &PackOptions{Window: 20, Depth: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(packdir, "*")); len(files) != 2 {
+		t.Errorf("expected pack and idx file, got %v", files)
+	}
+	repos, err := OpenRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repos.Close()
+	res, err := repos.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.OK() || res.Objects != len(oids) {
+		t.Errorf("%s: %d objects, problems %v", packpath, res.Objects, res.Problems)
+	}
+}
+
+func TestCreateDelta(t *testing.T) {
+	base := bytes.Repeat([]byte("0123456789abcdefghijklmnopqrstuvwxyz\n"), 3000)
+	target := append([]byte("new first line\n"), base[100:]...)
+	target = append(target[:50000:50000], append([]byte("inserted"), target[50000:]...)...)
+	delta := createDelta(base, target, len(target))
+	if delta == nil || len(delta) > 200 {
+		t.Fatalf("delta too large: %d bytes", len(delta))
+	}
+	baseLength, resultLength, pos, err := readDeltaLengths(delta)
+	if err != nil || baseLength != int64(len(base)) || resultLength != int64(len(target)) {
+		t.Fatalf("wrong delta header: %d %d %v", baseLength, resultLength, err)
+	}
+	result, err := applyDelta(delta[pos:], base, resultLength)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, target) {
+		t.Error("delta creates wrong result")
+	}
+	if createDelta(base, []byte("completely different content, nothing in common"), 10) != nil {
+		t.Error("expected no delta")
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright (c) 2013 Patrick Gundlach, speedata (Berlin, Germany)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gogit
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Abbreviated object ids must have at least this many hex digits (same
+// as git).
+const minPrefixLength = 4
+
+// AmbiguousPrefixError is returned by ResolvePrefix if the abbreviated
+// object id matches more than one object.
+type AmbiguousPrefixError struct {
+	Prefix string
+	// The matching objects, sorted
+	Candidates []*Oid
+}
+
+func (e *AmbiguousPrefixError) Error() string {
+	candidates := make([]string, len(e.Candidates))
+	for i, oid := range e.Candidates {
+		candidates[i] = oid.String()
+	}
+	return fmt.Sprintf("short object id %s is ambiguous, candidates are %s", e.Prefix, strings.Join(candidates, ", "))
+}
+
+// An abbreviated object id. An odd number of hex digits leaves the low
+// nibble of the last byte undefined.
+type oidPrefix struct {
+	hex      string
+	hashSize int    // length of a complete object id
+	bytes    []byte // all complete bytes
+	odd      bool
+	last     byte // the high nibble of the incomplete byte if odd
+}
+
+func newOidPrefix(prefix string, hash HashAlgorithm) (*oidPrefix, error) {
+	if len(prefix) < minPrefixLength || len(prefix) > hash.HexSize() {
+		return nil, fmt.Errorf("bad length %d of abbreviated object id, want %d to %d", len(prefix), minPrefixLength, hash.HexSize())
+	}
+	prefix = strings.ToLower(prefix)
+	p := &oidPrefix{hex: prefix, hashSize: hash.Size(), odd: len(prefix)%2 == 1}
+	even := prefix
+	if p.odd {
+		even = prefix + "0"
+	}
+	b, err := hex.DecodeString(even)
+	if err != nil {
+		return nil, err
+	}
+	if p.odd {
+		p.last = b[len(b)-1]
+		b = b[:len(b)-1]
+	}
+	p.bytes = b
+	return p, nil
+}
+
+// Return true if sha starts with the prefix.
+func (p *oidPrefix) matches(sha []byte) bool {
+	if !bytes.HasPrefix(sha, p.bytes) {
+		return false
+	}
+	return !p.odd || sha[len(p.bytes)]&0xf0 == p.last
+}
+
+// Return the smallest object id with the prefix.
+func (p *oidPrefix) lowest() []byte {
+	sha := make([]byte, p.hashSize)
+	copy(sha, p.bytes)
+	if p.odd {
+		sha[len(p.bytes)] = p.last
+	}
+	return sha
+}
+
+// Call f with every entry of the sorted sha table that starts with the
+// prefix.
+func (p *oidPrefix) searchTable(fanoutTable *[256]int64, shaTable []byte, f func(sha []byte)) {
+	size := int64(p.hashSize)
+	n, _ := searchSHA(fanoutTable, shaTable, p.hashSize, p.lowest())
+	for pos := n * size; pos+size <= int64(len(shaTable)); pos += size {
+		sha := shaTable[pos : pos+size]
+		if !p.matches(sha) {
+			break
+		}
+		f(sha)
+	}
+}
+
+// Add all objects in the store that start with the prefix to matches.
+func (store *objectStore) findPrefix(p *oidPrefix, matches map[string]bool) error {
+	add := func(sha []byte) {
+		matches[string(sha)] = true
+	}
+
+	// Loose objects are in a directory named after the first byte
+	files, err := ioutil.ReadDir(filepath.Join(store.dir, p.hex[:2]))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, fi := range files {
+		name := p.hex[:2] + fi.Name()
+		if len(name) != 2*p.hashSize || !strings.HasPrefix(name, p.hex) {
+			continue
+		}
+		if sha, err := hex.DecodeString(name); err == nil {
+			add(sha)
+		}
+	}
+
+	if store.midx != nil {
+		p.searchTable(&store.midx.fanoutTable, store.midx.shaTable, add)
+	}
+	for _, idx := range store.indexfiles {
+		if store.covered[idx] {
+			continue
+		}
+		p.searchTable(&idx.fanoutTable, idx.shaTable, add)
+	}
+	return nil
+}
+
+// Return the object whose id starts with the given hex digits, for
+// example from the abbreviated commit ids git prints. The prefix must
+// have at least 4 digits. If more than one object matches, the error is
+// an *AmbiguousPrefixError.
+func (repos *Repository) ResolvePrefix(prefix string) (*Oid, error) {
+	p, err := newOidPrefix(prefix, repos.hash)
+	if err != nil {
+		return nil, err
+	}
+	var oid *Oid
+	err = repos.lookup(func() error {
+		matches := make(map[string]bool)
+		for _, store := range repos.stores {
+			if err := store.findPrefix(p, matches); err != nil {
+				return err
+			}
+		}
+		switch len(matches) {
+		case 0:
+			return errObjNotFound
+		case 1:
+			for sha := range matches {
+				oid = &Oid{Bytes: []byte(sha)}
+			}
+			return nil
+		}
+		candidates := make([]*Oid, 0, len(matches))
+		for sha := range matches {
+			candidates = append(candidates, &Oid{Bytes: []byte(sha)})
+		}
+		sort.Slice(candidates, func(i, j int) bool {
+			return bytes.Compare(candidates[i].Bytes, candidates[j].Bytes) < 0
+		})
+		return &AmbiguousPrefixError{Prefix: prefix, Candidates: candidates}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return oid, nil
+}
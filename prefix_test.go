@@ -0,0 +1,87 @@
+package gogit
+
+import (
+	"testing"
+)
+
+func TestResolvePrefix(t *testing.T) {
+	repos, err := OpenRepository("_testdata/prefix.git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repos.Close()
+
+	// 69b954bc... is in the pack file, 69b95e05... is a loose object
+	testdata := []struct {
+		prefix string
+		oid    string
+	}{
+		{"69b954", "69b954bc896d135c5ec073c607fa2b0c402c9a84"},
+		{"69b954bc896d135c5ec073c607fa2b0c402c9a84", "69b954bc896d135c5ec073c607fa2b0c402c9a84"},
+		{"69b95e", "69b95e057e4e7b8b4a4786db071aeab1ad2b810b"},
+		{"69B95E0", "69b95e057e4e7b8b4a4786db071aeab1ad2b810b"},
+	}
+	for _, td := range testdata {
+		oid, err := repos.ResolvePrefix(td.prefix)
+		if err != nil {
+			t.Error(td.prefix, err)
+			continue
+		}
+		if oid.String() != td.oid {
+			t.Errorf("ResolvePrefix(%q) = %s, want %s", td.prefix, oid, td.oid)
+		}
+	}
+
+	for _, prefix := range []string{"69b9", "69b95"} {
+		_, err = repos.ResolvePrefix(prefix)
+		amb, ok := err.(*AmbiguousPrefixError)
+		if !ok {
+			t.Fatalf("ResolvePrefix(%q): expected ambiguity error, got %v", prefix, err)
+		}
+		if len(amb.Candidates) != 2 ||
+			amb.Candidates[0].String() != "69b954bc896d135c5ec073c607fa2b0c402c9a84" ||
+			amb.Candidates[1].String() != "69b95e057e4e7b8b4a4786db071aeab1ad2b810b" {
+			t.Errorf("ResolvePrefix(%q): wrong candidates %v", prefix, amb.Candidates)
+		}
+	}
+
+	if _, err = repos.ResolvePrefix("69b953"); err != errObjNotFound {
+		t.Error("expected object not found, got", err)
+	}
+	for _, prefix := range []string{"69b", "69b9xx", "69b954bc896d135c5ec073c607fa2b0c402c9a841"} {
+		if _, err = repos.ResolvePrefix(prefix); err == nil {
+			t.Errorf("ResolvePrefix(%q): expected error", prefix)
+		}
+	}
+}
+
+func TestResolvePrefixAlternates(t *testing.T) {
+	repos, err := OpenRepository("_testdata/alternates.git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repos.Close()
+	// The commit is a loose object in testrepo.git
+	oid, err := repos.ResolvePrefix("1337a1a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oid.String() != "1337a1a1b0694887722f8bd0e541bd0f6567a471" {
+		t.Error("wrong object", oid)
+	}
+}
+
+func TestResolvePrefixMidx(t *testing.T) {
+	repos, err := OpenRepository("_testdata/midx.git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repos.Close()
+	oid, err := repos.ResolvePrefix("b371abcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oid.String() != "b371abcdc3aa99c0f688e19811bfce76cefff2e4" {
+		t.Error("wrong object", oid)
+	}
+}
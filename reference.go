@@ -27,23 +27,62 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strings"
 )
 
+// A reference is either direct, pointing to an object, or symbolic,
+// pointing to another reference.
+type ReferenceType int
+
+const (
+	ReferenceOid ReferenceType = iota + 1
+	ReferenceSymbolic
+)
+
+// A reference (branch, tag, HEAD, ...). Oid is the object the reference
+// points to, for symbolic references the object at the end of the chain
+// of references.
 type Reference struct {
 	Name       string
 	Oid        *Oid
-	dest       string
+	dest       string // the target of a symbolic reference
+	peeled     *Oid   // the peeled id of a tag from packed-refs, if known
 	repository *Repository
 }
 
+// The error returned when symbolic references form a loop.
+type ReferenceLoopError struct {
+	// The names of the references, starting with the one being
+	// resolved, ending with the one seen before
+	Chain []string
+}
+
+func (e *ReferenceLoopError) Error() string {
+	return "reference loop: " + strings.Join(e.Chain, " -> ")
+}
+
+// The error returned when a symbolic reference points to a reference
+// that doesn't exist, such as HEAD in a new repository before the first
+// commit.
+type UnbornBranchError struct {
+	// The name of the missing reference, for example refs/heads/master
+	Name string
+}
+
+func (e *UnbornBranchError) Error() string {
+	return "unborn branch " + e.Name
+}
+
 func resolveFrom(path, name string) (*Reference, error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
-	sha1, err := findRef(f, name)
+	sha1, peeled, err := findRef(f, name)
 	if err != nil {
 		return nil, err
 	}
@@ -51,7 +90,13 @@ func resolveFrom(path, name string) (*Reference, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Reference{Name: name, Oid: oid}, nil
+	ref := &Reference{Name: name, Oid: oid}
+	if peeled != nil {
+		if ref.peeled, err = NewOidFromByteString(peeled); err != nil {
+			return nil, err
+		}
+	}
+	return ref, nil
 }
 
 var (
@@ -61,35 +106,76 @@ var (
 
 // findRef parses a list of SHA1/ref pairs such as those
 // found in info/refs, packed-refs, or the output of git ls-remote.
-// It looks for ref and returns the corresponding hex-encoded SHA1.
-func findRef(r io.Reader, ref string) ([]byte, error) {
+// It looks for ref and returns the corresponding hex-encoded SHA1 and, if
+// the list has it, the id of the object the (tag) reference peels to.
+// packed-refs has it in a line "^<SHA1>" after the reference, info/refs
+// in a line "<SHA1> <ref>^{}".
+func findRef(r io.Reader, ref string) (sha1, peeled []byte, err error) {
 	refb := []byte(ref)
+	peeledName := []byte(ref + "^{}")
 	scan := bufio.NewScanner(r)
 	for scan.Scan() {
 		line := bytes.TrimSpace(scan.Bytes())
 		if len(line) == 0 || line[0] == '#' {
 			continue
 		}
+		if sha1 != nil {
+			// The line after the reference
+			if line[0] == '^' && isHexId(line[1:]) {
+				peeled = append([]byte(nil), line[1:]...)
+			} else if ff := bytes.Fields(line); len(ff) == 2 && isHexId(ff[0]) && bytes.Equal(ff[1], peeledName) {
+				peeled = append([]byte(nil), ff[0]...)
+			}
+			return sha1, peeled, nil
+		}
 		// It appears that info/refs uses tabs to separate sha1s,
 		// whereas packed-refs uses spaces. Be agnostic.
 		ff := bytes.Fields(line)
-		if len(ff) != 2 || len(ff[0]) != 40 || !bytes.Equal(refb, ff[1]) {
+		if len(ff) != 2 || !isHexId(ff[0]) || !bytes.Equal(refb, ff[1]) || bytes.HasSuffix(ff[1], []byte("^{}")) {
 			continue
 		}
 		// Found a well-formed match.
-		return ff[0], nil
+		sha1 = append([]byte(nil), ff[0]...)
 	}
 	if err := scan.Err(); err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	if sha1 != nil {
+		return sha1, nil, nil
 	}
-	return nil, errRefNotFound
+	return nil, nil, errRefNotFound
+}
+
+// Return true if b has the length of a hex encoded object id.
+func isHexId(b []byte) bool {
+	return len(b) == 40 || len(b) == 64
 }
 
 var refColon = []byte("ref: ")
 
 // A typical Git repository consists of objects (path objects/ in the root directory)
-// and of references to HEAD, branches, tags and such.
+// and of references to HEAD, branches, tags and such. Symbolic references
+// are resolved: the returned reference keeps its name (for example HEAD)
+// and its Oid is the one of the last reference in the chain, see Resolve.
 func (repos *Repository) LookupReference(name string) (*Reference, error) {
+	if err := repos.checkOpen(); err != nil {
+		return nil, err
+	}
+	ref, err := repos.readReference(name)
+	if err != nil {
+		return nil, err
+	}
+	if ref.dest != "" {
+		if _, err = ref.Resolve(); err != nil {
+			return nil, err
+		}
+	}
+	return ref, nil
+}
+
+// Read the reference name without resolving it. Return errRefNotFound if
+// there is no such reference.
+func (repos *Repository) readReference(name string) (*Reference, error) {
 	// First we need to find out what's in the text file. It could be something like
 	//     ref: refs/heads/master
 	// or just a SHA1 such as
@@ -100,20 +186,18 @@ func (repos *Repository) LookupReference(name string) (*Reference, error) {
 	f, err := ioutil.ReadFile(filepath.Join(repos.Path, name))
 	if err != nil {
 		if os.IsNotExist(err) {
-			// Try looking it up in info/refs and packed-refs.
-			paths := [...]string{
-				filepath.Join(ref.repository.Path, "info", "refs"),
-				filepath.Join(ref.repository.Path, "packed-refs"),
+			// Try looking it up in packed-refs. Like git, gogit doesn't
+			// read info/refs, which is written by git update-server-info
+			// for dumb HTTP clients and is usually out of date.
+			destref, err := resolveFrom(filepath.Join(repos.Path, "packed-refs"), name)
+			if err == nil {
+				destref.repository = repos
+				return destref, nil
 			}
-			var destref *Reference
-			var err error
-			for _, path := range paths {
-				destref, err = resolveFrom(path, name)
-				if err == nil {
-					break
-				}
+			if err != errRefNotFound && !os.IsNotExist(err) {
+				return nil, err
 			}
-			return destref, err
+			return nil, errRefNotFound
 		}
 		return nil, err
 	}
@@ -127,12 +211,272 @@ func (repos *Repository) LookupReference(name string) (*Reference, error) {
 		ref.Oid = oid
 		return ref, nil
 	}
-	// yes, it's "ref: something". Now let's lookup "something"
+	// yes, it's "ref: something".
 	ref.dest = string(b[len(refColon):])
-	return repos.LookupReference(ref.dest)
+	return ref, nil
+}
+
+// Return ReferenceSymbolic if the reference points to another reference,
+// ReferenceOid if it points to an object.
+func (r *Reference) Type() ReferenceType {
+	if r.dest != "" {
+		return ReferenceSymbolic
+	}
+	return ReferenceOid
+}
+
+// Return the name of the reference a symbolic reference points to, such
+// as "refs/heads/master" for HEAD. Return "" for direct references.
+func (r *Reference) SymbolicTarget() string {
+	return r.dest
+}
+
+// Follow the chain of symbolic references starting at r. Return all
+// references of the chain, starting with r and ending with a direct
+// reference. The Oid of the symbolic references in the chain is set to the
+// one of the direct reference. A loop of symbolic references is a
+// ReferenceLoopError, a missing target an UnbornBranchError.
+func (r *Reference) Resolve() ([]*Reference, error) {
+	chain := []*Reference{r}
+	seen := map[string]bool{r.Name: true}
+	for ref := r; ref.dest != ""; {
+		if seen[ref.dest] {
+			names := make([]string, 0, len(chain)+1)
+			for _, ref := range chain {
+				names = append(names, ref.Name)
+			}
+			return nil, &ReferenceLoopError{Chain: append(names, ref.dest)}
+		}
+		seen[ref.dest] = true
+		next, err := r.repository.readReference(ref.dest)
+		if err == errRefNotFound {
+			return nil, &UnbornBranchError{Name: ref.dest}
+		}
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, next)
+		ref = next
+	}
+	last := chain[len(chain)-1]
+	for _, ref := range chain {
+		ref.Oid, ref.peeled = last.Oid, last.peeled
+	}
+	return chain, nil
+}
+
+// Return the id of the object of type t the reference points to,
+// following annotated tags, which may point to other tags. A commit peels
+// to its tree. Peeling to a type that is not in the chain, such as a tag
+// of a tree to ObjectCommit, is an error. The peeled ids stored in
+// packed-refs are used, so that no tag objects need to be read.
+func (r *Reference) Peel(t ObjectType) (*Oid, error) {
+	if r.peeled != nil && t != ObjectTag {
+		return r.repository.peel(r.peeled, t)
+	}
+	return r.repository.peel(r.Oid, t)
+}
+
+// Return the reference HEAD, usually a symbolic reference to the current
+// branch. In a new repository without commits, the error is an
+// UnbornBranchError.
+func (repos *Repository) Head() (*Reference, error) {
+	return repos.LookupReference("HEAD")
+}
+
+// Return true if HEAD points directly to a commit instead of a branch.
+func (repos *Repository) IsHeadDetached() (bool, error) {
+	if err := repos.checkOpen(); err != nil {
+		return false, err
+	}
+	head, err := repos.readReference("HEAD")
+	if err != nil {
+		return false, err
+	}
+	return head.dest == "", nil
+}
+
+// Return true if HEAD points to a branch that doesn't exist yet, as in
+// a new repository without commits.
+func (repos *Repository) IsHeadUnborn() (bool, error) {
+	_, err := repos.Head()
+	if _, ok := err.(*UnbornBranchError); ok {
+		return true, nil
+	}
+	return false, err
 }
 
 // For compatibility with git2go. Return Oid from referece (same as getting .Oid directly)
 func (r *Reference) Target() *Oid {
 	return r.Oid
 }
+
+// Read a list of "<hex id> <name>" lines such as packed-refs or info/refs
+// and return the references by name. The peeled ids of tags ("^<hex id>"
+// lines in packed-refs, "<hex id> <name>^{}" lines in info/refs) are
+// stored with the references, see findRef. A missing file is an empty
+// list.
+func readRefList(path string) (map[string]*Reference, error) {
+	refs := make(map[string]*Reference)
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return refs, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var last *Reference
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		line := bytes.TrimSpace(scan.Bytes())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		if line[0] == '^' {
+			if last != nil {
+				last.peeled, _ = NewOidFromByteString(line[1:])
+			}
+			continue
+		}
+		last = nil
+		ff := bytes.Fields(line)
+		if len(ff) != 2 || !bytes.HasPrefix(ff[1], []byte("refs/")) {
+			continue
+		}
+		oid, err := NewOidFromByteString(ff[0])
+		if err != nil {
+			continue
+		}
+		if name := bytes.TrimSuffix(ff[1], []byte("^{}")); len(name) < len(ff[1]) {
+			if ref := refs[string(name)]; ref != nil {
+				ref.peeled = oid
+			}
+			continue
+		}
+		last = &Reference{Name: string(ff[1]), Oid: oid}
+		refs[last.Name] = last
+	}
+	return refs, scan.Err()
+}
+
+// Return all references below refs/, sorted by name. Loose references
+// override the ones in packed-refs, info/refs is not read (see
+// readReference). Symbolic references are resolved, references that
+// can't be resolved are left out.
+func (repos *Repository) readReferences() ([]*Reference, error) {
+	refs, err := readRefList(filepath.Join(repos.Path, "packed-refs"))
+	if err != nil {
+		return nil, err
+	}
+	for _, ref := range refs {
+		ref.repository = repos
+	}
+	err = filepath.Walk(filepath.Join(repos.Path, "refs"), func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !fi.Mode().IsRegular() || strings.HasSuffix(path, ".lock") {
+			return nil
+		}
+		rel, err := filepath.Rel(repos.Path, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		delete(refs, name)
+		ref, err := repos.LookupReference(name)
+		if err == ErrClosed {
+			return err
+		}
+		if err == nil {
+			refs[name] = ref
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sorted := make([]*Reference, 0, len(refs))
+	for _, ref := range refs {
+		sorted = append(sorted, ref)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+	return sorted, nil
+}
+
+// Call fn for every reference below refs/ (branches, tags, remote
+// branches, ...) in the order of their names. Loose references take
+// precedence over packed ones, symbolic references are resolved and
+// references that can't be resolved are skipped. If fn returns an error,
+// the iteration stops and ForEachReference returns this error.
+func (repos *Repository) ForEachReference(fn func(ref *Reference) error) error {
+	if err := repos.checkOpen(); err != nil {
+		return err
+	}
+	refs, err := repos.readReferences()
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		if err = fn(ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Return the references matching pattern, sorted by name. Like git
+// for-each-ref, a pattern matches a reference if it is a prefix of the
+// name up to a slash ("refs/heads" matches "refs/heads/master") or if it
+// matches the name as a shell pattern (see path.Match, for example
+// "refs/tags/v1.*"). An empty pattern matches all references.
+func (repos *Repository) References(pattern string) ([]*Reference, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	prefix := strings.TrimSuffix(pattern, "/") + "/"
+	var refs []*Reference
+	err := repos.ForEachReference(func(ref *Reference) error {
+		if matched, _ := path.Match(pattern, ref.Name); matched || pattern == "" || strings.HasPrefix(ref.Name, prefix) {
+			refs = append(refs, ref)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return refs, nil
+}
+
+// Return the local branches (refs/heads/...).
+func (repos *Repository) Branches() ([]*Reference, error) {
+	return repos.References("refs/heads")
+}
+
+// Return the tags (refs/tags/...).
+func (repos *Repository) Tags() ([]*Reference, error) {
+	return repos.References("refs/tags")
+}
+
+// Return the remote-tracking branches (refs/remotes/...).
+func (repos *Repository) RemoteBranches() ([]*Reference, error) {
+	return repos.References("refs/remotes")
+}
+
+// Return the short name of the reference such as "master" for
+// "refs/heads/master", "v1" for "refs/tags/v1" or "origin/master" for
+// "refs/remotes/origin/master".
+func (r *Reference) ShortName() string {
+	for _, prefix := range []string{"refs/heads/", "refs/tags/", "refs/remotes/"} {
+		if strings.HasPrefix(r.Name, prefix) {
+			return r.Name[len(prefix):]
+		}
+	}
+	return r.Name
+}
@@ -0,0 +1,413 @@
+package gogit
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func refNames(refs []*Reference) []string {
+	names := make([]string, len(refs))
+	for i, ref := range refs {
+		names[i] = ref.Name
+	}
+	return names
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestForEachReference(t *testing.T) {
+	dir := copyRepository(t, "_testdata/testrepo.git")
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"refs/remotes/origin/master": "29ad9d799ae51db518d09d307125bcc212688eb4\n",
+		"refs/remotes/origin/HEAD":   "ref: refs/remotes/origin/master\n",
+		"refs/tags/v1.0":             "29ad9d799ae51db518d09d307125bcc212688eb4\n",
+		"refs/tags/v2.0":             "1337a1a1b0694887722f8bd0e541bd0f6567a471\n",
+		"refs/heads/broken":          "ref: refs/heads/doesnotexist\n",
+		"refs/heads/master.lock":     "29ad9d799ae51db518d09d307125bcc212688eb4\n",
+		"info/refs":                  "7647bdef73cde0888222b7ea00f5e83b151a25d0\trefs/heads/master\n29ad9d799ae51db518d09d307125bcc212688eb4\trefs/heads/testpackedref\n1337a1a1b0694887722f8bd0e541bd0f6567a471\trefs/tags/v2.0^{}\n",
+	}
+	for name, contents := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	repos, err := OpenRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repos.Close()
+
+	expected := map[string]string{
+		// loose overrides packed-refs
+		"refs/heads/master": "1337a1a1b0694887722f8bd0e541bd0f6567a471",
+		// info/refs is ignored
+		"refs/heads/testpackedref":   "4603c3eaa3c08accbc887bee3e6294af9cd4bdda",
+		"refs/remotes/origin/HEAD":   "29ad9d799ae51db518d09d307125bcc212688eb4",
+		"refs/remotes/origin/master": "29ad9d799ae51db518d09d307125bcc212688eb4",
+		"refs/tags/tag1":             "e6f8d0db36fd0e048979d115478abec90682bd78",
+		"refs/tags/v1.0":             "29ad9d799ae51db518d09d307125bcc212688eb4",
+		"refs/tags/v2.0":             "1337a1a1b0694887722f8bd0e541bd0f6567a471",
+	}
+	var names []string
+	err = repos.ForEachReference(func(ref *Reference) error {
+		names = append(names, ref.Name)
+		if ref.Oid.String() != expected[ref.Name] {
+			t.Errorf("%s: got %s, want %s", ref.Name, ref.Oid, expected[ref.Name])
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"refs/heads/master", "refs/heads/testpackedref", "refs/remotes/origin/HEAD", "refs/remotes/origin/master", "refs/tags/tag1", "refs/tags/v1.0", "refs/tags/v2.0"}
+	if !equalStrings(names, want) {
+		t.Errorf("got %v, want %v", names, want)
+	}
+
+	stop := errors.New("stop")
+	count := 0
+	err = repos.ForEachReference(func(ref *Reference) error {
+		count++
+		return stop
+	})
+	if err != stop || count != 1 {
+		t.Errorf("iteration not stopped: %v, %d", err, count)
+	}
+
+	testdata := []struct {
+		refs func() ([]*Reference, error)
+		want []string
+	}{
+		{repos.Branches, []string{"refs/heads/master", "refs/heads/testpackedref"}},
+		{repos.Tags, []string{"refs/tags/tag1", "refs/tags/v1.0", "refs/tags/v2.0"}},
+		{repos.RemoteBranches, []string{"refs/remotes/origin/HEAD", "refs/remotes/origin/master"}},
+		{func() ([]*Reference, error) { return repos.References("refs/tags/v*") }, []string{"refs/tags/v1.0", "refs/tags/v2.0"}},
+		{func() ([]*Reference, error) { return repos.References("refs/remotes/origin/") }, []string{"refs/remotes/origin/HEAD", "refs/remotes/origin/master"}},
+		{func() ([]*Reference, error) { return repos.References("refs/head") }, []string{}},
+	}
+	for i, td := range testdata {
+		refs, err := td.refs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := refNames(refs); !equalStrings(got, td.want) {
+			t.Errorf("%d: got %v, want %v", i, got, td.want)
+		}
+	}
+	if _, err = repos.References("refs/["); err == nil {
+		t.Error("expected error for malformed pattern")
+	}
+
+	refs, _ := repos.RemoteBranches()
+	if refs[1].ShortName() != "origin/master" {
+		t.Errorf("short name %s", refs[1].ShortName())
+	}
+	repos.Close()
+	if err = repos.ForEachReference(func(*Reference) error { return nil }); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+}
+
+// info/refs is written by git update-server-info and is not updated when
+// references change, so it is not read.
+func TestStaleInfoRefs(t *testing.T) {
+	dir := copyRepository(t, "_testdata/testrepo.git")
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"packed-refs": "7647bdef73cde0888222b7ea00f5e83b151a25d0 refs/heads/master\n1337a1a1b0694887722f8bd0e541bd0f6567a471 refs/heads/testpackedref\n",
+		"info/refs":   "7647bdef73cde0888222b7ea00f5e83b151a25d0\trefs/heads/master\n4603c3eaa3c08accbc887bee3e6294af9cd4bdda\trefs/heads/testpackedref\n29ad9d799ae51db518d09d307125bcc212688eb4\trefs/heads/infoonly\n",
+	}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, filepath.FromSlash(name)), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	repos, err := OpenRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repos.Close()
+
+	expected := map[string]string{
+		"refs/heads/master":        "1337a1a1b0694887722f8bd0e541bd0f6567a471", // loose
+		"refs/heads/testpackedref": "1337a1a1b0694887722f8bd0e541bd0f6567a471",
+	}
+	branches, err := repos.Branches()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(branches) != len(expected) {
+		t.Errorf("got branches %v", refNames(branches))
+	}
+	for _, ref := range branches {
+		if ref.Oid.String() != expected[ref.Name] {
+			t.Errorf("Branches: %s is %s, want %s", ref.Name, ref.Oid, expected[ref.Name])
+		}
+	}
+	for name, oid := range expected {
+		ref, err := repos.LookupReference(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ref.Oid.String() != oid {
+			t.Errorf("LookupReference: %s is %s, want %s", name, ref.Oid, oid)
+		}
+	}
+	if _, err = repos.LookupReference("refs/heads/infoonly"); err != errRefNotFound {
+		t.Errorf("LookupReference: expected errRefNotFound for a reference in info/refs, got %v", err)
+	}
+}
+
+func TestSymbolicReference(t *testing.T) {
+	dir := copyRepository(t, "_testdata/testrepo.git")
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"refs/heads/alias":  "ref: refs/heads/alias2\n",
+		"refs/heads/alias2": "ref: refs/heads/master\n",
+		"refs/heads/loop1":  "ref: refs/heads/loop2\n",
+		"refs/heads/loop2":  "ref: refs/heads/loop1\n",
+		"refs/heads/self":   "ref: refs/heads/self\n",
+	}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, filepath.FromSlash(name)), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	repos, err := OpenRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repos.Close()
+
+	ref, err := repos.LookupReference("refs/heads/alias")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref.Name != "refs/heads/alias" || ref.Type() != ReferenceSymbolic || ref.SymbolicTarget() != "refs/heads/alias2" {
+		t.Errorf("wrong symbolic reference %s -> %s", ref.Name, ref.SymbolicTarget())
+	}
+	if ref.Oid.String() != "1337a1a1b0694887722f8bd0e541bd0f6567a471" {
+		t.Errorf("resolved to %s", ref.Oid)
+	}
+	chain, err := ref.Resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := refNames(chain); !equalStrings(got, []string{"refs/heads/alias", "refs/heads/alias2", "refs/heads/master"}) {
+		t.Errorf("chain %v", got)
+	}
+	if last := chain[len(chain)-1]; last.Type() != ReferenceOid || last.SymbolicTarget() != "" {
+		t.Error("end of chain is not a direct reference")
+	}
+
+	// Packed references are direct references
+	ref, err = repos.LookupReference("refs/heads/testpackedref")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref.Type() != ReferenceOid {
+		t.Error("packed reference is not direct")
+	}
+	if chain, err = ref.Resolve(); err != nil || len(chain) != 1 || chain[0] != ref {
+		t.Errorf("resolve direct reference: %v, %v", chain, err)
+	}
+
+	for _, name := range []string{"refs/heads/loop1", "refs/heads/self"} {
+		_, err = repos.LookupReference(name)
+		if e, ok := err.(*ReferenceLoopError); !ok || e.Chain[0] != name || e.Chain[len(e.Chain)-1] != name {
+			t.Errorf("%s: expected ReferenceLoopError, got %v", name, err)
+		}
+	}
+	if _, err = repos.LookupReference("refs/heads/doesnotexist"); err != errRefNotFound {
+		t.Errorf("expected errRefNotFound, got %v", err)
+	}
+}
+
+func TestHead(t *testing.T) {
+	dir := copyRepository(t, "_testdata/testrepo.git")
+	defer os.RemoveAll(dir)
+	repos, err := OpenRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repos.Close()
+
+	writeHead := func(contents string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, "HEAD"), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testdata := []struct {
+		head     string
+		detached bool
+		unborn   bool
+	}{
+		{"ref: refs/heads/master\n", false, false},
+		{"29ad9d799ae51db518d09d307125bcc212688eb4\n", true, false},
+		{"ref: refs/heads/newbranch\n", false, true},
+	}
+	for _, td := range testdata {
+		writeHead(td.head)
+		detached, err := repos.IsHeadDetached()
+		if err != nil || detached != td.detached {
+			t.Errorf("%q: detached %t, %v", td.head, detached, err)
+		}
+		unborn, err := repos.IsHeadUnborn()
+		if err != nil || unborn != td.unborn {
+			t.Errorf("%q: unborn %t, %v", td.head, unborn, err)
+		}
+		head, err := repos.Head()
+		if td.unborn {
+			if e, ok := err.(*UnbornBranchError); !ok || e.Name != "refs/heads/newbranch" {
+				t.Errorf("expected UnbornBranchError, got %v", err)
+			}
+		} else if err != nil || head.Name != "HEAD" {
+			t.Errorf("%q: head %v, %v", td.head, head, err)
+		}
+	}
+}
+
+func TestFindRefPeeled(t *testing.T) {
+	packedRefs := "# pack-refs with: peeled fully-peeled \n" +
+		"1337a1a1b0694887722f8bd0e541bd0f6567a471 refs/heads/master\n" +
+		"e6f8d0db36fd0e048979d115478abec90682bd78 refs/tags/tag1\n" +
+		"^1337a1a1b0694887722f8bd0e541bd0f6567a471\n"
+	infoRefs := "e6f8d0db36fd0e048979d115478abec90682bd78\trefs/tags/tag1\n" +
+		"1337a1a1b0694887722f8bd0e541bd0f6567a471\trefs/tags/tag1^{}\n" +
+		"1337a1a1b0694887722f8bd0e541bd0f6567a471\trefs/heads/master\n"
+	for _, list := range []string{packedRefs, infoRefs} {
+		sha1, peeled, err := findRef(strings.NewReader(list), "refs/tags/tag1")
+		if err != nil || string(sha1) != "e6f8d0db36fd0e048979d115478abec90682bd78" || string(peeled) != "1337a1a1b0694887722f8bd0e541bd0f6567a471" {
+			t.Errorf("tag1: %s %s %v", sha1, peeled, err)
+		}
+		sha1, peeled, err = findRef(strings.NewReader(list), "refs/heads/master")
+		if err != nil || string(sha1) != "1337a1a1b0694887722f8bd0e541bd0f6567a471" || peeled != nil {
+			t.Errorf("master: %s %s %v", sha1, peeled, err)
+		}
+		if _, _, err = findRef(strings.NewReader(list), "refs/tags/tag1^{}"); err != errRefNotFound {
+			t.Errorf("peeled line found as reference: %v", err)
+		}
+	}
+}
+
+func TestPeel(t *testing.T) {
+	dir := copyRepository(t, "_testdata/testrepo.git")
+	defer os.RemoveAll(dir)
+	repos, err := OpenRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repos.Close()
+
+	commitId := "1337a1a1b0694887722f8bd0e541bd0f6567a471"
+	treeId := "7cc610f7268f024d3684a3778ff5aac89c2515bc"
+	tag1 := mustOidFromString(t, "e6f8d0db36fd0e048979d115478abec90682bd78")
+	sig := &Signature{Name: "Patrick Gundlach", Email: "gundlach@speedata.de", When: time.Unix(1378823654, 0)}
+	// A tag of a tag and a tag of a tree
+	tagOfTag, err := repos.WriteTag(tag1, TagTag, "tag2", sig, "Tag of a tag\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tagOfTree, err := repos.WriteTag(mustOidFromString(t, treeId), TagTree, "treetag", sig, "Tag of a tree\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refs := map[string]*Oid{"refs/tags/tag2": tagOfTag, "refs/tags/treetag": tagOfTree}
+	for name, oid := range refs {
+		if err = ioutil.WriteFile(filepath.Join(dir, filepath.FromSlash(name)), []byte(oid.String()+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testdata := []struct {
+		ref  string
+		t    ObjectType
+		want string // "" for an error
+	}{
+		{"refs/tags/tag1", ObjectCommit, commitId},
+		{"refs/tags/tag1", ObjectTree, treeId},
+		{"refs/tags/tag1", ObjectTag, tag1.String()},
+		{"refs/tags/tag1", ObjectBlob, ""},
+		{"refs/tags/tag2", ObjectCommit, commitId},
+		{"refs/tags/tag2", ObjectTag, tagOfTag.String()},
+		{"refs/tags/treetag", ObjectTree, treeId},
+		{"refs/tags/treetag", ObjectCommit, ""},
+		{"refs/heads/master", ObjectCommit, commitId},
+		{"HEAD", ObjectTree, treeId},
+		{"HEAD", ObjectTag, ""},
+	}
+	for _, td := range testdata {
+		ref, err := repos.LookupReference(td.ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		oid, err := ref.Peel(td.t)
+		switch {
+		case td.want == "" && err == nil:
+			t.Errorf("%s to %s: expected error, got %s", td.ref, td.t, oid)
+		case td.want != "" && err != nil:
+			t.Errorf("%s to %s: %s", td.ref, td.t, err)
+		case td.want != "" && oid.String() != td.want:
+			t.Errorf("%s to %s: got %s, want %s", td.ref, td.t, oid, td.want)
+		}
+	}
+
+	ci, err := repos.PeelToCommit(tagOfTag)
+	if err != nil || ci.Id().String() != commitId {
+		t.Errorf("PeelToCommit: %v %v", ci, err)
+	}
+	if _, err = repos.PeelToCommit(tagOfTree); err == nil {
+		t.Error("PeelToCommit of a tree tag: expected error")
+	}
+
+	// The peeled id from packed-refs is used without reading the tag.
+	// Here it deliberately differs from the tag's target.
+	packedRefs := "# pack-refs with: peeled fully-peeled \n" +
+		"e6f8d0db36fd0e048979d115478abec90682bd78 refs/tags/packedtag\n" +
+		"^29ad9d799ae51db518d09d307125bcc212688eb4\n"
+	if err = ioutil.WriteFile(filepath.Join(dir, "packed-refs"), []byte(packedRefs), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, lookup := range []func() (*Reference, error){
+		func() (*Reference, error) { return repos.LookupReference("refs/tags/packedtag") },
+		func() (*Reference, error) {
+			refs, err := repos.References("refs/tags/packedtag")
+			if err != nil || len(refs) != 1 {
+				return nil, fmt.Errorf("References: %v %v", refs, err)
+			}
+			return refs[0], nil
+		},
+	} {
+		ref, err := lookup()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if oid, err := ref.Peel(ObjectCommit); err != nil || oid.String() != "29ad9d799ae51db518d09d307125bcc212688eb4" {
+			t.Errorf("peel data not used: %v %v", oid, err)
+		}
+		if oid, err := ref.Peel(ObjectTag); err != nil || !oid.Equal(tag1) {
+			t.Errorf("peel to tag: %v %v", oid, err)
+		}
+	}
+}
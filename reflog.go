@@ -0,0 +1,140 @@
+// Copyright (c) 2013 Patrick Gundlach, speedata (Berlin, Germany)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gogit
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// An entry of a reflog: the reference changed from Old to New. Old is
+// all zeros when the reference was created.
+type ReflogEntry struct {
+	Old       *Oid
+	New       *Oid
+	Committer *Signature
+	Message   string
+}
+
+// Parse a reflog line
+//
+//	<old> <new> Patrick Gundlach <gundlach@speedata.de> 1378823654 +0200<TAB>commit: message
+func parseReflogEntry(line []byte) (*ReflogEntry, error) {
+	var err error
+	entry := new(ReflogEntry)
+	fields := bytes.SplitN(line, []byte(" "), 3)
+	if len(fields) != 3 {
+		return nil, errors.New("Malformed reflog entry: " + string(line))
+	}
+	if entry.Old, err = NewOidFromByteString(fields[0]); err != nil {
+		return nil, err
+	}
+	if entry.New, err = NewOidFromByteString(fields[1]); err != nil {
+		return nil, err
+	}
+	sig := fields[2]
+	if tab := bytes.IndexByte(sig, '\t'); tab >= 0 {
+		entry.Message = string(sig[tab+1:])
+		sig = sig[:tab]
+	}
+	if entry.Committer, err = newSignatureFromCommitline(sig); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// Return the entries of the reflog of the reference refname (for example
+// HEAD or refs/heads/master) from logs/<refname>, oldest first. A
+// reference without reflog has no entries.
+func (repos *Repository) Reflog(refname string) ([]*ReflogEntry, error) {
+	if err := repos.checkOpen(); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(filepath.Join(repos.Path, "logs", filepath.FromSlash(refname)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var entries []*ReflogEntry
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		line := scan.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		entry, err := parseReflogEntry(line)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	if err = scan.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Return the reflog entry for a specification such as "HEAD@{1}",
+// "master@{0}" or "@{2}" (which is HEAD): @{n} is the n-th latest entry,
+// @{0} the latest. The object the reference pointed to is the New id of
+// the entry. Like git, a name without refs/ is looked up as refs/<name>,
+// refs/tags/<name>, refs/heads/<name> and refs/remotes/<name>.
+func (repos *Repository) LookupReflogEntry(spec string) (*ReflogEntry, error) {
+	at := strings.LastIndex(spec, "@{")
+	if at < 0 || !strings.HasSuffix(spec, "}") {
+		return nil, errors.New("Malformed reflog specification: " + spec)
+	}
+	n, err := strconv.Atoi(spec[at+2 : len(spec)-1])
+	if err != nil || n < 0 {
+		return nil, errors.New("Malformed reflog specification: " + spec)
+	}
+	name := spec[:at]
+	if name == "" {
+		name = "HEAD"
+	}
+	candidates := []string{name}
+	if name != "HEAD" && !strings.HasPrefix(name, "refs/") {
+		candidates = append(candidates, "refs/"+name, "refs/tags/"+name, "refs/heads/"+name, "refs/remotes/"+name)
+	}
+	for _, refname := range candidates {
+		entries, err := repos.Reflog(refname)
+		if err != nil {
+			return nil, err
+		}
+		if entries == nil {
+			continue
+		}
+		if n >= len(entries) {
+			return nil, fmt.Errorf("reflog of %s has only %d entries", refname, len(entries))
+		}
+		return entries[len(entries)-1-n], nil
+	}
+	return nil, errors.New("No reflog for " + name)
+}
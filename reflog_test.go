@@ -0,0 +1,128 @@
+package gogit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReflog(t *testing.T) {
+	repos, err := OpenRepository("_testdata/reflog.git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repos.Close()
+	const (
+		zero   = "0000000000000000000000000000000000000000"
+		first  = "e273351c352001dd353199a42b40497f21c7cafb"
+		second = "8e0a50a94d89a9ad9da1201636dff3242aabe4a3"
+	)
+	entries, err := repos.Reflog("HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		old, new string
+		time     int64
+		offset   int
+		message  string
+	}{
+		{zero, first, 1378823654, 2 * 3600, "commit (initial): one"},
+		{first, second, 1378823700, -90 * 60, "commit: two"},
+		{second, second, 1378823800, 0, "checkout: moving from master to topic"},
+		{second, first, 1378823900, 0, "reset: moving to HEAD~1"},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("got %d entries, want %d", len(entries), len(want))
+	}
+	for i, w := range want {
+		e := entries[i]
+		if e.Old.String() != w.old || e.New.String() != w.new || e.Message != w.message {
+			t.Errorf("entry %d: %s %s %q", i, e.Old, e.New, e.Message)
+		}
+		if _, offset := e.Committer.When.Zone(); e.Committer.When.Unix() != w.time || offset != w.offset {
+			t.Errorf("entry %d: time %s", i, e.Committer.When)
+		}
+		if e.Committer.Name != "Patrick Gundlach" || e.Committer.Email != "gundlach@speedata.de" {
+			t.Errorf("entry %d: committer %s <%s>", i, e.Committer.Name, e.Committer.Email)
+		}
+	}
+
+	if entries, err = repos.Reflog("refs/heads/doesnotexist"); err != nil || entries != nil {
+		t.Errorf("expected no entries, got %v, %v", entries, err)
+	}
+
+	testdata := []struct {
+		spec string
+		want string // "" for an error
+	}{
+		{"HEAD@{0}", first},
+		{"@{1}", second},
+		{"HEAD@{3}", first},
+		{"HEAD@{4}", ""},
+		{"master@{0}", second},
+		{"refs/heads/master@{1}", first},
+		{"heads/topic@{1}", second},
+		{"topic@{0}", first},
+		{"doesnotexist@{0}", ""},
+		{"HEAD@{-1}", ""},
+		{"HEAD@{x}", ""},
+		{"HEAD", ""},
+	}
+	for _, td := range testdata {
+		entry, err := repos.LookupReflogEntry(td.spec)
+		switch {
+		case td.want == "" && err == nil:
+			t.Errorf("%s: expected error", td.spec)
+		case td.want != "" && err != nil:
+			t.Errorf("%s: %s", td.spec, err)
+		case td.want != "" && entry.New.String() != td.want:
+			t.Errorf("%s: got %s, want %s", td.spec, entry.New, td.want)
+		}
+	}
+}
+
+// Like git, refs/tags/<name> is tried before refs/heads/<name>.
+func TestReflogTagBeforeBranch(t *testing.T) {
+	dir := copyRepository(t, "_testdata/reflog.git")
+	defer os.RemoveAll(dir)
+	const tagged = "8e0a50a94d89a9ad9da1201636dff3242aabe4a3"
+	logdir := filepath.Join(dir, "logs", "refs", "tags")
+	if err := os.MkdirAll(logdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	line := "0000000000000000000000000000000000000000 " + tagged + " Patrick Gundlach <gundlach@speedata.de> 1378824000 +0000\ttag: topic\n"
+	if err := ioutil.WriteFile(filepath.Join(logdir, "topic"), []byte(line), 0644); err != nil {
+		t.Fatal(err)
+	}
+	repos, err := OpenRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repos.Close()
+	entry, err := repos.LookupReflogEntry("topic@{0}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.New.String() != tagged {
+		t.Errorf("topic@{0} is %s, want the entry of refs/tags/topic %s", entry.New, tagged)
+	}
+}
+
+func TestParseReflogEntry(t *testing.T) {
+	entry, err := parseReflogEntry([]byte("0000000000000000000000000000000000000000 e273351c352001dd353199a42b40497f21c7cafb Patrick Gundlach <gundlach@speedata.de> 1378823654 +0200"))
+	if err != nil || entry.Message != "" {
+		t.Errorf("entry without message: %v %v", entry, err)
+	}
+	for _, line := range []string{
+		"",
+		"e273351c352001dd353199a42b40497f21c7cafb",
+		"e273351c352001dd353199a42b40497f21c7cafb e273351c Patrick Gundlach <gundlach@speedata.de> 1378823654 +0200\tx",
+		"e273351c352001dd353199a42b40497f21c7cafb e273351c352001dd353199a42b40497f21c7cafb Patrick Gundlach\tx",
+	} {
+		if _, err := parseReflogEntry([]byte(line)); err == nil {
+			t.Errorf("%q: expected error", line)
+		}
+	}
+}
@@ -0,0 +1,406 @@
+// Copyright (c) 2013 Patrick Gundlach, speedata (Berlin, Germany)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gogit
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The error returned when a lock file exists, usually because another
+// process is updating the same reference.
+type LockError struct {
+	Path string // the lock file
+}
+
+func (e *LockError) Error() string {
+	return "unable to create " + e.Path + ": lock file exists"
+}
+
+// The error returned when a reference doesn't have the expected value in
+// UpdateReference or DeleteReference.
+type ReferenceConflictError struct {
+	Name     string
+	Expected *Oid
+	Actual   *Oid // nil if the reference doesn't exist
+}
+
+func (e *ReferenceConflictError) Error() string {
+	actual := "missing"
+	if e.Actual != nil {
+		actual = "at " + e.Actual.String()
+	}
+	return fmt.Sprintf("reference %s is %s, expected %s", e.Name, actual, e.Expected)
+}
+
+// Return an error if name is not a valid name for a reference (see git
+// check-ref-format).
+func checkRefName(name string) error {
+	if name == "HEAD" {
+		return nil
+	}
+	invalid := !strings.HasPrefix(name, "refs/") || strings.HasSuffix(name, "/") ||
+		strings.HasSuffix(name, ".") || strings.Contains(name, "..") ||
+		strings.Contains(name, "@{") || strings.ContainsAny(name, " ~^:?*[\\\x7f")
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part[0] == '.' || strings.HasSuffix(part, ".lock") {
+			invalid = true
+		}
+	}
+	for _, c := range name {
+		if c < 0x20 {
+			invalid = true
+		}
+	}
+	if invalid {
+		return errors.New("Invalid reference name: " + name)
+	}
+	return nil
+}
+
+// A lock file <path>.lock, created the way git does it: it must not exist
+// yet. Its contents replace the file at path on commit.
+type lockFile struct {
+	path string
+	f    *os.File
+}
+
+func createLockFile(path string) (*lockFile, error) {
+	f, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			return nil, &LockError{Path: path + ".lock"}
+		}
+		return nil, err
+	}
+	return &lockFile{path: path, f: f}, nil
+}
+
+// Write the data to the lock file and rename it to its path.
+func (l *lockFile) commit(data []byte) error {
+	if _, err := l.f.Write(data); err != nil {
+		l.rollback()
+		return err
+	}
+	if err := l.f.Close(); err != nil {
+		l.rollback()
+		return err
+	}
+	if err := os.Rename(l.path+".lock", l.path); err != nil {
+		os.Remove(l.path + ".lock")
+		return err
+	}
+	return nil
+}
+
+// Remove the lock file without changing the file at path.
+func (l *lockFile) rollback() {
+	l.f.Close()
+	os.Remove(l.path + ".lock")
+}
+
+// Return the current value of the (direct) reference name, loose or
+// packed, or nil if it doesn't exist.
+func (repos *Repository) currentRefValue(name string) (*Oid, error) {
+	ref, err := repos.readReference(name)
+	if err == errRefNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ref.Oid, nil
+}
+
+// Return an error if the value of the reference is not the expected one.
+// A nil expected value matches everything, an all zero value a missing
+// reference.
+func checkRefValue(name string, current, expected *Oid) error {
+	if expected == nil {
+		return nil
+	}
+	zero := bytes.Count(expected.Bytes, []byte{0}) == len(expected.Bytes)
+	if zero && current == nil || current != nil && current.Equal(expected) {
+		return nil
+	}
+	return &ReferenceConflictError{Name: name, Expected: expected, Actual: current}
+}
+
+// Set the reference name to newOid and append an entry with logMessage
+// to its reflog. Like git, a lock file <name>.lock is created first, if it
+// already exists, the error is a LockError. If expectedOld is not nil,
+// the reference must currently have this value (loose or packed) or must
+// not exist if expectedOld is all zeros, otherwise the error is a
+// ReferenceConflictError and nothing is changed. A symbolic reference
+// such as HEAD is followed and the reference at the end of the chain is
+// updated, the reflogs of the symbolic references are updated as well.
+// The reference is created if it doesn't exist.
+func (repos *Repository) UpdateReference(name string, newOid, expectedOld *Oid, logMessage string) error {
+	if err := repos.checkOpen(); err != nil {
+		return err
+	}
+	if err := checkRefName(name); err != nil {
+		return err
+	}
+	if err := repos.checkOidSize(newOid); err != nil {
+		return err
+	}
+	// Follow symbolic references, the last one might not exist yet.
+	target := name
+	var symbolic []string
+	for {
+		ref, err := repos.readReference(target)
+		if err == errRefNotFound {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if ref.dest == "" {
+			break
+		}
+		symbolic = append(symbolic, target)
+		for _, seen := range symbolic {
+			if seen == ref.dest {
+				return &ReferenceLoopError{Chain: append(symbolic, ref.dest)}
+			}
+		}
+		target = ref.dest
+	}
+	if err := checkRefName(target); err != nil {
+		return err
+	}
+
+	path := filepath.Join(repos.Path, filepath.FromSlash(target))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	lock, err := createLockFile(path)
+	if err != nil {
+		return err
+	}
+	old, err := repos.currentRefValue(target)
+	if err == nil {
+		err = checkRefValue(target, old, expectedOld)
+	}
+	if err != nil {
+		lock.rollback()
+		return err
+	}
+	if err = lock.commit([]byte(newOid.String() + "\n")); err != nil {
+		return err
+	}
+
+	// git also logs updates of the current branch in the reflog of HEAD
+	if head, err := repos.readReference("HEAD"); err == nil && head.dest == target && (len(symbolic) == 0 || symbolic[0] != "HEAD") {
+		symbolic = append(symbolic, "HEAD")
+	}
+	if old == nil {
+		old = &Oid{Bytes: make([]byte, repos.hash.Size())}
+	}
+	for _, refname := range append(symbolic, target) {
+		if err = repos.appendReflog(refname, old, newOid, logMessage); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete the reference name, a symbolic reference is deleted itself, not
+// the reference it points to. If expectedOld is not nil, the reference
+// must currently have this value (see UpdateReference). The reference is
+// removed from packed-refs as well, which is locked while it is
+// rewritten. Like git, info/refs is not changed. The reflog of the
+// reference is deleted.
+func (repos *Repository) DeleteReference(name string, expectedOld *Oid) error {
+	if err := repos.checkOpen(); err != nil {
+		return err
+	}
+	if err := checkRefName(name); err != nil {
+		return err
+	}
+	notFound := errors.New("Reference not found: " + name)
+	if _, err := repos.readReference(name); err != nil {
+		if err == errRefNotFound {
+			return notFound
+		}
+		return err
+	}
+	// A packed reference might not have a directory for the lock file
+	path := filepath.Join(repos.Path, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	lock, err := createLockFile(path)
+	if err != nil {
+		return err
+	}
+	defer lock.rollback()
+	// Read the reference again, it might have changed before it was locked
+	ref, err := repos.readReference(name)
+	if err == errRefNotFound {
+		return notFound
+	}
+	if err != nil {
+		return err
+	}
+	if expectedOld != nil && ref.dest != "" {
+		if _, err = ref.Resolve(); err != nil {
+			return err
+		}
+	}
+	if err = checkRefValue(name, ref.Oid, expectedOld); err != nil {
+		return err
+	}
+	if err = removeFromRefList(filepath.Join(repos.Path, "packed-refs"), name); err != nil {
+		return err
+	}
+	if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = os.Remove(filepath.Join(repos.Path, "logs", filepath.FromSlash(name)))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Rewrite packed-refs at path without the reference name and its peeled
+// line, see findRef. The file is locked while it is rewritten. Nothing is
+// written if name is not in the list.
+func removeFromRefList(path, name string) error {
+	lock, err := createLockFile(path)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		lock.rollback()
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var buf bytes.Buffer
+	found, skipPeeled := false, false
+	scan := bufio.NewScanner(bytes.NewReader(data))
+	for scan.Scan() {
+		line := scan.Bytes()
+		ff := bytes.Fields(line)
+		if skipPeeled && len(line) > 0 && line[0] == '^' || len(ff) == 2 && string(ff[1]) == name+"^{}" {
+			continue
+		}
+		skipPeeled = false
+		if len(ff) == 2 && line[0] != '#' && string(ff[1]) == name {
+			found, skipPeeled = true, true
+			continue
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	if err = scan.Err(); err != nil || !found {
+		lock.rollback()
+		return err
+	}
+	return lock.commit(buf.Bytes())
+}
+
+// Return the identity for reflog entries: GIT_COMMITTER_NAME and
+// GIT_COMMITTER_EMAIL from the environment or user.name and user.email
+// from the repository config.
+func (repos *Repository) committer() (*Signature, error) {
+	config, err := readConfig(filepath.Join(repos.Path, "config"))
+	if err != nil {
+		return nil, err
+	}
+	sig := &Signature{Name: os.Getenv("GIT_COMMITTER_NAME"), Email: os.Getenv("GIT_COMMITTER_EMAIL"), When: time.Now()}
+	if sig.Name == "" {
+		sig.Name = config["user.name"]
+	}
+	if sig.Email == "" {
+		sig.Email = config["user.email"]
+	}
+	if sig.Name == "" {
+		sig.Name = "unknown"
+	}
+	return sig, sig.validate()
+}
+
+// Return true if updates of the reference name are logged even if it
+// has no reflog yet, see core.logAllRefUpdates in git-config(1).
+func (repos *Repository) logAllRefUpdates(name string) (bool, error) {
+	config, err := readConfig(filepath.Join(repos.Path, "config"))
+	if err != nil {
+		return false, err
+	}
+	value, ok := config["core.logallrefupdates"]
+	if !ok {
+		// The default is true in repositories with a working tree
+		value = "true"
+		if config["core.bare"] == "true" {
+			value = "false"
+		}
+	}
+	switch value {
+	case "always":
+		return true, nil
+	case "true":
+		return name == "HEAD" || strings.HasPrefix(name, "refs/heads/") || strings.HasPrefix(name, "refs/remotes/") || strings.HasPrefix(name, "refs/notes/"), nil
+	}
+	return false, nil
+}
+
+// Append an entry to the reflog of the reference name if it has a reflog
+// or if updates are logged (see logAllRefUpdates).
+func (repos *Repository) appendReflog(name string, oldOid, newOid *Oid, message string) error {
+	path := filepath.Join(repos.Path, "logs", filepath.FromSlash(name))
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		logAll, err := repos.logAllRefUpdates(name)
+		if err != nil || !logAll {
+			return err
+		}
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+	}
+	sig, err := repos.committer()
+	if err != nil {
+		return err
+	}
+	message = strings.Replace(strings.TrimSpace(message), "\n", " ", -1)
+	line := oldOid.String() + " " + newOid.String() + " " + sig.commitline() + "\t" + message + "\n"
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.WriteString(line); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,225 @@
+package gogit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUpdateReference(t *testing.T) {
+	t.Setenv("GIT_COMMITTER_NAME", "")
+	t.Setenv("GIT_COMMITTER_EMAIL", "")
+	dir := copyRepository(t, "_testdata/testrepo.git")
+	defer os.RemoveAll(dir)
+	config := "[core]\n\tbare = false\n[user]\n\tname = Patrick Gundlach\n\temail = gundlach@speedata.de\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "config"), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	repos, err := OpenRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repos.Close()
+
+	master := mustOidFromString(t, "1337a1a1b0694887722f8bd0e541bd0f6567a471")
+	parent := mustOidFromString(t, "29ad9d799ae51db518d09d307125bcc212688eb4")
+	zero := &Oid{Bytes: make([]byte, 20)}
+	lookup := func(name string) *Oid {
+		ref, err := repos.LookupReference(name)
+		if err != nil {
+			return nil
+		}
+		return ref.Oid
+	}
+
+	// compare and swap
+	if err = repos.UpdateReference("refs/heads/master", parent, master, "reset: moving to HEAD~1"); err != nil {
+		t.Fatal(err)
+	}
+	if oid := lookup("refs/heads/master"); oid == nil || !oid.Equal(parent) {
+		t.Errorf("master is %v", oid)
+	}
+	err = repos.UpdateReference("refs/heads/master", master, master, "")
+	if e, ok := err.(*ReferenceConflictError); !ok || !e.Actual.Equal(parent) {
+		t.Errorf("expected ReferenceConflictError, got %v", err)
+	}
+	if oid := lookup("refs/heads/master"); oid == nil || !oid.Equal(parent) {
+		t.Errorf("master changed to %v", oid)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "refs", "heads", "master.lock")); !os.IsNotExist(err) {
+		t.Error("lock file not removed")
+	}
+
+	// The current branch is logged in the reflog of HEAD as well
+	for _, name := range []string{"HEAD", "refs/heads/master"} {
+		entries, err := repos.Reflog(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 || !entries[0].Old.Equal(master) || !entries[0].New.Equal(parent) || entries[0].Message != "reset: moving to HEAD~1" || entries[0].Committer.Name != "Patrick Gundlach" {
+			t.Errorf("%s: wrong reflog %v", name, entries)
+		}
+	}
+
+	// Updating through HEAD updates the branch
+	if err = repos.UpdateReference("HEAD", master, nil, "commit: again\nsecond line"); err != nil {
+		t.Fatal(err)
+	}
+	if oid := lookup("refs/heads/master"); oid == nil || !oid.Equal(master) {
+		t.Errorf("master is %v", oid)
+	}
+	if head, _ := repos.readReference("HEAD"); head.SymbolicTarget() != "refs/heads/master" {
+		t.Error("HEAD is not symbolic any more")
+	}
+	if entry, err := repos.LookupReflogEntry("HEAD@{0}"); err != nil || entry.Message != "commit: again second line" {
+		t.Errorf("HEAD@{0}: %v %v", entry, err)
+	}
+	if entries, _ := repos.Reflog("HEAD"); len(entries) != 2 {
+		t.Errorf("HEAD logged %d times", len(entries))
+	}
+
+	// packed reference
+	packed := mustOidFromString(t, "4603c3eaa3c08accbc887bee3e6294af9cd4bdda")
+	err = repos.UpdateReference("refs/heads/testpackedref", master, parent, "")
+	if _, ok := err.(*ReferenceConflictError); !ok {
+		t.Errorf("expected ReferenceConflictError, got %v", err)
+	}
+	if err = repos.UpdateReference("refs/heads/testpackedref", master, packed, ""); err != nil {
+		t.Fatal(err)
+	}
+	if oid := lookup("refs/heads/testpackedref"); oid == nil || !oid.Equal(master) {
+		t.Errorf("testpackedref is %v", oid)
+	}
+
+	// create
+	if err = repos.UpdateReference("refs/heads/feature/x", master, parent, ""); err == nil {
+		t.Error("expected error for missing reference")
+	}
+	if err = repos.UpdateReference("refs/heads/feature/x", master, zero, "branch: Created from master"); err != nil {
+		t.Fatal(err)
+	}
+	if err = repos.UpdateReference("refs/heads/feature/x", master, zero, ""); err == nil {
+		t.Error("expected error for existing reference")
+	}
+	if entry, err := repos.LookupReflogEntry("feature/x@{0}"); err != nil || !entry.Old.Equal(zero) {
+		t.Errorf("feature/x@{0}: %v %v", entry, err)
+	}
+	// Tags are not logged
+	if err = repos.UpdateReference("refs/tags/v1", master, zero, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "logs", "refs", "tags", "v1")); !os.IsNotExist(err) {
+		t.Error("tag update logged")
+	}
+
+	// locked
+	lock := filepath.Join(dir, "refs", "heads", "master.lock")
+	if err = ioutil.WriteFile(lock, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = repos.UpdateReference("refs/heads/master", parent, nil, "")
+	if e, ok := err.(*LockError); !ok || e.Path != lock {
+		t.Errorf("expected LockError, got %v", err)
+	}
+	if _, err = os.Stat(lock); err != nil {
+		t.Error("foreign lock file removed")
+	}
+
+	for _, name := range []string{"master", "refs/heads/a..b", "refs/heads/x.lock", "refs/heads/", "refs/heads/a b", "refs/heads/.hidden", "refs/heads/a@{1}"} {
+		if err = repos.UpdateReference(name, master, nil, ""); err == nil {
+			t.Errorf("%q: expected error", name)
+		}
+	}
+}
+
+func TestDeleteReference(t *testing.T) {
+	dir := copyRepository(t, "_testdata/testrepo.git")
+	defer os.RemoveAll(dir)
+	packedRefs := "# pack-refs with: peeled fully-peeled \n" +
+		"7647bdef73cde0888222b7ea00f5e83b151a25d0 refs/heads/master\n" +
+		"e6f8d0db36fd0e048979d115478abec90682bd78 refs/tags/packedtag\n" +
+		"^1337a1a1b0694887722f8bd0e541bd0f6567a471\n" +
+		"4603c3eaa3c08accbc887bee3e6294af9cd4bdda refs/heads/testpackedref\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "packed-refs"), []byte(packedRefs), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// An out of date info/refs, which must be ignored and left alone
+	infoRefs := "7647bdef73cde0888222b7ea00f5e83b151a25d0\trefs/heads/master\n29ad9d799ae51db518d09d307125bcc212688eb4\trefs/heads/testpackedref\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "info", "refs"), []byte(infoRefs), 0644); err != nil {
+		t.Fatal(err)
+	}
+	repos, err := OpenRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repos.Close()
+
+	master := mustOidFromString(t, "1337a1a1b0694887722f8bd0e541bd0f6567a471")
+	err = repos.DeleteReference("refs/tags/packedtag", master)
+	if _, ok := err.(*ReferenceConflictError); !ok {
+		t.Errorf("expected ReferenceConflictError, got %v", err)
+	}
+	if err = repos.DeleteReference("refs/tags/packedtag", mustOidFromString(t, "e6f8d0db36fd0e048979d115478abec90682bd78")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "packed-refs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Replace(packedRefs, "e6f8d0db36fd0e048979d115478abec90682bd78 refs/tags/packedtag\n^1337a1a1b0694887722f8bd0e541bd0f6567a471\n", "", 1)
+	if string(data) != want {
+		t.Errorf("packed-refs is\n%s", data)
+	}
+
+	// loose and packed
+	if err = repos.DeleteReference("refs/heads/master", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = repos.LookupReference("refs/heads/master"); err != errRefNotFound {
+		t.Errorf("master not deleted: %v", err)
+	}
+	if unborn, _ := repos.IsHeadUnborn(); !unborn {
+		t.Error("HEAD should be unborn")
+	}
+	if err = repos.DeleteReference("refs/heads/master", nil); err == nil {
+		t.Error("expected error for missing reference")
+	}
+	refs, err := repos.References("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := refNames(refs); !equalStrings(got, []string{"refs/heads/testpackedref", "refs/tags/tag1"}) {
+		t.Errorf("references left: %v", got)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.lock")); len(files) != 0 {
+		t.Errorf("lock files left: %v", files)
+	}
+	if data, err = ioutil.ReadFile(filepath.Join(dir, "info", "refs")); err != nil || string(data) != infoRefs {
+		t.Errorf("info/refs changed: %v\n%s", err, data)
+	}
+	if err = repos.DeleteReference("refs/heads/no/such/branch", nil); err == nil {
+		t.Error("expected error for missing reference")
+	}
+	if _, err = os.Stat(filepath.Join(dir, "refs", "heads", "no")); !os.IsNotExist(err) {
+		t.Error("directory created for missing reference")
+	}
+
+	// compare and swap against the packed value, not info/refs
+	packed := mustOidFromString(t, "4603c3eaa3c08accbc887bee3e6294af9cd4bdda")
+	stale := mustOidFromString(t, "29ad9d799ae51db518d09d307125bcc212688eb4")
+	if _, ok := repos.UpdateReference("refs/heads/testpackedref", master, stale, "").(*ReferenceConflictError); !ok {
+		t.Error("expected ReferenceConflictError for the info/refs value")
+	}
+	if err = repos.UpdateReference("refs/heads/testpackedref", master, packed, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ioutil.WriteFile(filepath.Join(dir, "packed-refs.lock"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := repos.DeleteReference("refs/heads/testpackedref", nil).(*LockError); !ok {
+		t.Error("expected LockError for packed-refs")
+	}
+}
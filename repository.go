@@ -21,6 +21,7 @@
 package gogit
 
 import (
+	"bufio"
 	"bytes"
 	"compress/zlib"
 	"encoding/binary"
@@ -31,17 +32,107 @@ import (
 	"path/filepath"
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/speedata/mmap-go"
 )
 
 // A Repository is the base of all other actions. If you need to lookup a
 // commit, tree or blob, you do it from here.
+//
+// A Repository holds open files and caches, call Close to release them
+// when the repository is not needed anymore. After Close, all lookups
+// return ErrClosed. Objects retrieved before Close (commits, trees, ...)
+// stay usable, but methods that need to read more objects from the
+// repository, such as Commit.Parent or Tree.Walk, fail.
+//
+// A Repository is safe for concurrent use by multiple goroutines.
 type Repository struct {
-	Path       string
-	indexfiles []*idxFile
+	Path string
+
+	// The hash algorithm used for object ids, from the repository config
+	hash HashAlgorithm
+
+	// The objects directory of the repository and its alternates
+	stores []*objectStore
+
+	commitGraph *commitGraph
+
+	deltaBaseCache *deltaBaseCache
+	objectCache    *objectCache
+
+	// mu protects closed and the pack files and is held (read locked) during
+	// each lookup, so Close and rescanPacks wait for running lookups
+	// before releasing files.
+	mu     sync.RWMutex
+	closed bool
+
+	packRescanInterval time.Duration
+	lastPackScan       time.Time
+
+	maxObjectSize int64
+	maxDeltaDepth int
 }
 
+// ErrClosed is returned by all lookups on a closed repository.
+var ErrClosed = errors.New("repository is closed")
+
+// ErrObjectTooLarge is returned when an object is larger than
+// RepositoryOptions.MaxObjectSize.
+var ErrObjectTooLarge = errors.New("object too large")
+
+// ErrDeltaChainTooDeep is returned when an object in a pack file is
+// stored as a chain of more than RepositoryOptions.MaxDeltaDepth deltas.
+var ErrDeltaChainTooDeep = errors.New("delta chain too deep")
+
+// Settings for OpenRepositoryWithOptions. The zero value of each field
+// selects the default.
+type RepositoryOptions struct {
+	// Maximum number of bytes used to cache the inflated base objects of
+	// deltified objects in pack files. Defaults to 96 MB, a negative
+	// value disables the cache.
+	DeltaBaseCacheLimit int64
+
+	// Number of parsed commits and trees to keep in memory. Defaults to 0
+	// (no caching). With the cache enabled, LookupCommit and LookupTree
+	// return the same *Commit or *Tree for repeated lookups of an object,
+	// so these must not be modified by the caller.
+	ObjectCacheSize int
+
+	// When an object is not found, the pack directory is read again to
+	// pick up new pack files (for example after git gc or a push) and to
+	// drop pack files that have been removed. This happens at most once
+	// per PackRescanInterval, which defaults to one second. A negative
+	// value disables rescanning.
+	PackRescanInterval time.Duration
+
+	// Additional object directories to search for objects, like
+	// GIT_ALTERNATE_OBJECT_DIRECTORIES. The alternates listed in
+	// objects/info/alternates are always used.
+	AlternateObjectDirectories []string
+
+	// Objects larger than MaxObjectSize bytes are not read, lookups
+	// return ErrObjectTooLarge instead. The sizes of deltified objects
+	// and their bases are checked before they are inflated. Defaults to
+	// 0 (no limit).
+	MaxObjectSize int64
+
+	// Objects stored as a chain of more than MaxDeltaDepth deltas are not
+	// read, lookups return ErrDeltaChainTooDeep instead. Defaults to
+	// 10000, git itself doesn't create chains of more than 4095 deltas.
+	MaxDeltaDepth int
+}
+
+const (
+	defaultPackRescanInterval = time.Second
+	defaultMaxDeltaDepth      = 10000
+)
+
+// Deflate can't compress data by more than this factor, so a declared
+// object size beyond that is a sign of a corrupt or malicious object.
+const maxDeflateRatio = 1032
+
+// A SHA-1 object id, see NewOidFromArray.
 type SHA1 [20]byte
 
 // Who am I?
@@ -62,6 +153,24 @@ func (t ObjectType) String() string {
 		return "Tree"
 	case ObjectBlob:
 		return "Blob"
+	case ObjectTag:
+		return "Tag"
+	default:
+		return ""
+	}
+}
+
+// Return the name of the type as used in object headers ("blob 1234\0")
+func (t ObjectType) headerName() string {
+	switch t {
+	case ObjectCommit:
+		return "commit"
+	case ObjectTree:
+		return "tree"
+	case ObjectBlob:
+		return "blob"
+	case ObjectTag:
+		return "tag"
 	default:
 		return ""
 	}
@@ -72,106 +181,291 @@ type Object struct {
 	Oid  *Oid
 }
 
-// idx-file
+// idx-file and the pack file it belongs to. Both files are memory mapped
+// as long as the repository is open.
 type idxFile struct {
+	path     string
 	packpath string
+	hashSize int
+	version  int
 
 	fanoutTable [256]int64
 
-	// These tables are sub-slices of the whole idx file as an mmap
+	// These tables are sub-slices of the whole idx file as an mmap. In
+	// version 1 idx files, object ids and offsets are interleaved, so
+	// shaTable and offsetTable are copies.
 	shaTable     []byte
 	offsetTable  []byte
 	offset8Table []byte
+	crcTable     []byte // CRC32 of the packed objects, version 2 only
+
+	// The checksum of the pack file
+	packChecksum []byte
+
+	idxMmap  mmap.MMap
+	packMmap mmap.MMap
+
+	// Readers returned by readObjectStream access the pack file after
+	// the lookup has returned, the pack file gets unmapped when the
+	// last one is closed.
+	mu     sync.Mutex
+	refs   int
+	closed bool
+}
+
+// A CorruptIndexError is returned when a pack index (idx) file is
+// damaged or doesn't belong to its pack file.
+type CorruptIndexError struct {
+	Path   string // the idx file
+	Reason string
+}
+
+func (e *CorruptIndexError) Error() string {
+	return fmt.Sprintf("corrupt pack index %s: %s", e.Path, e.Reason)
+}
+
+// An UnsupportedIndexVersionError is returned for pack index (idx) files
+// of a version other than 1 or 2.
+type UnsupportedIndexVersionError struct {
+	Path    string // the idx file
+	Version uint32
 }
 
-func readIdxFile(path string) (*idxFile, error) {
-	ifile := &idxFile{}
+func (e *UnsupportedIndexVersionError) Error() string {
+	return fmt.Sprintf("pack index %s has unsupported version %d", e.Path, e.Version)
+}
+
+// Version 2 idx files start with this signature. A version 1 idx file
+// starts with the fanout table, the first entry can't be this large.
+var idxSignature = []byte{255, 't', 'O', 'c'}
+
+func readIdxFile(path string, hash HashAlgorithm) (*idxFile, error) {
+	ifile := &idxFile{path: path, hashSize: hash.Size()}
 	ifile.packpath = path[0:len(path)-3] + "pack"
 
-	idxf, err := os.Open(path)
+	var err error
+	ifile.idxMmap, err = mapFile(path)
 	if err != nil {
 		return nil, err
 	}
-	defer idxf.Close()
-	idxMmap, err := mmap.Map(idxf, mmap.RDONLY, 0)
+	if err = ifile.parse(); err != nil {
+		ifile.unmap()
+		return nil, err
+	}
+
+	ifile.packMmap, err = mapFile(ifile.packpath)
 	if err != nil {
+		ifile.unmap()
 		return nil, err
 	}
-	defer idxMmap.Unmap()
+	if !bytes.HasPrefix(ifile.packMmap, []byte{'P', 'A', 'C', 'K'}) {
+		ifile.unmap()
+		return nil, errors.New("Pack file does not start with 'PACK'")
+	}
+	// The pack file ends with its checksum
+	if len(ifile.packMmap) < 12+ifile.hashSize || !bytes.Equal(ifile.packMmap[len(ifile.packMmap)-ifile.hashSize:], ifile.packChecksum) {
+		ifile.unmap()
+		return nil, &CorruptIndexError{Path: path, Reason: "pack checksum doesn't match " + ifile.packpath}
+	}
+	return ifile, nil
+}
 
-	if !bytes.HasPrefix(idxMmap, []byte{255, 't', 'O', 'c'}) {
-		return nil, errors.New("Not version 2 index file")
+// Check the idx file and set up the tables.
+func (idx *idxFile) parse() error {
+	data := idx.idxMmap
+	corrupt := func(format string, a ...interface{}) error {
+		return &CorruptIndexError{Path: idx.path, Reason: fmt.Sprintf(format, a...)}
 	}
 
-	for i := range ifile.fanoutTable {
-		pos := 8 + i*4
-		u32 := binary.BigEndian.Uint32(idxMmap[pos : pos+4])
-		ifile.fanoutTable[i] = int64(u32)
+	idx.version = 1
+	fanoutStart := int64(0)
+	if bytes.HasPrefix(data, idxSignature) {
+		if len(data) < 8 {
+			return corrupt("file truncated")
+		}
+		if version := binary.BigEndian.Uint32(data[4:8]); version != 2 {
+			return &UnsupportedIndexVersionError{Path: idx.path, Version: version}
+		}
+		idx.version = 2
+		fanoutStart = 8
 	}
 
-	numObjects := ifile.fanoutTable[byte(255)]
+	// At the end are two checksums, first of the pack file, then of the
+	// idx file itself.
+	hashSize := int64(idx.hashSize)
+	size := int64(len(data))
+	if size < fanoutStart+256*4+2*hashSize {
+		return corrupt("file truncated")
+	}
+	// The checksum of the idx file itself is only checked by Verify, it
+	// would need to read the whole file.
+	idx.packChecksum = data[size-2*hashSize : size-hashSize]
 
-	shaStart := int64(8 + 256*4)
-	ifile.shaTable = make([]byte, len(idxMmap[shaStart : shaStart+20*numObjects]))
-	copy(ifile.shaTable, idxMmap[shaStart : shaStart+20*numObjects])
+	for i := range idx.fanoutTable {
+		pos := fanoutStart + int64(i)*4
+		idx.fanoutTable[i] = int64(binary.BigEndian.Uint32(data[pos : pos+4]))
+		if i > 0 && idx.fanoutTable[i] < idx.fanoutTable[i-1] {
+			return corrupt("fanout table is not monotonic at entry %d", i)
+		}
+	}
 
-	offsetStart := shaStart + 24*numObjects
-	ifile.offsetTable = make([]byte, len(idxMmap[offsetStart : offsetStart+4*numObjects]))
-	copy(ifile.offsetTable, idxMmap[offsetStart : offsetStart+4*numObjects])
+	numObjects := idx.fanoutTable[byte(255)]
+	tables := data[fanoutStart+256*4 : size-2*hashSize]
+	if idx.version == 1 {
+		// offset and object id of each object
+		entrySize := 4 + hashSize
+		if int64(len(tables)) != numObjects*entrySize {
+			return corrupt("wrong file size for %d objects", numObjects)
+		}
+		idx.shaTable = make([]byte, numObjects*hashSize)
+		idx.offsetTable = make([]byte, numObjects*4)
+		for i := int64(0); i < numObjects; i++ {
+			entry := tables[i*entrySize : (i+1)*entrySize]
+			copy(idx.offsetTable[i*4:], entry[:4])
+			copy(idx.shaTable[i*hashSize:], entry[4:])
+		}
+		return nil
+	}
 
-	offset8Start := offsetStart + 4*numObjects
-	ifile.offset8Table = make([]byte, len(idxMmap[offset8Start : len(idxMmap)-40]))
-	copy(ifile.offset8Table, idxMmap[offset8Start : len(idxMmap)-40])
+	// object ids, crc32 checksums, offsets and 8 byte offsets of objects
+	// beyond 2GB
+	minSize := numObjects * (hashSize + 8)
+	if int64(len(tables)) < minSize || (int64(len(tables))-minSize)%8 != 0 {
+		return corrupt("wrong file size for %d objects", numObjects)
+	}
+	idx.shaTable = tables[:numObjects*hashSize]
+	idx.crcTable = tables[numObjects*hashSize : numObjects*(hashSize+4)]
+	offsetStart := numObjects * (hashSize + 4)
+	idx.offsetTable = tables[offsetStart : offsetStart+numObjects*4]
+	idx.offset8Table = tables[offsetStart+numObjects*4:]
+	return nil
+}
 
-	fi, err := os.Open(ifile.packpath)
-	if err != nil {
-		return nil, err
+// Return a CorruptIndexError if the checksum at the end of the idx file
+// doesn't match its contents.
+func (idx *idxFile) checkChecksum(hash HashAlgorithm) error {
+	data := idx.idxMmap
+	h := hash.New()
+	h.Write(data[:len(data)-idx.hashSize])
+	if !bytes.Equal(h.Sum(nil), data[len(data)-idx.hashSize:]) {
+		return &CorruptIndexError{Path: idx.path, Reason: "checksum mismatch"}
 	}
-	defer fi.Close()
+	return nil
+}
 
-	packVersion := make([]byte, 8)
-	_, err = io.ReadFull(fi, packVersion)
+// Map the whole file at path read-only into memory.
+func mapFile(path string) (mmap.MMap, error) {
+	f, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
-	if !bytes.HasPrefix(packVersion, []byte{'P', 'A', 'C', 'K'}) {
-		return nil, errors.New("Pack file does not start with 'PACK'")
+	defer f.Close()
+	return mmap.Map(f, mmap.RDONLY, 0)
+}
+
+// Prevent the pack file from being unmapped until release is called.
+// Return false if the idx file is already closed.
+func (idx *idxFile) acquire() bool {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.closed {
+		return false
 	}
-	return ifile, nil
+	idx.refs++
+	return true
+}
+
+func (idx *idxFile) release() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.refs--
+	if idx.closed && idx.refs == 0 {
+		return idx.unmap()
+	}
+	return nil
 }
 
-func (idx *idxFile) offsetForSHA(target SHA1) uint64 {
+// Unmap the idx and the pack file once all readers are released.
+func (idx *idxFile) close() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.closed {
+		return nil
+	}
+	idx.closed = true
+	if idx.refs == 0 {
+		return idx.unmap()
+	}
+	return nil
+}
+
+func (idx *idxFile) unmap() error {
+	var err error
+	if idx.idxMmap != nil {
+		err = idx.idxMmap.Unmap()
+		idx.idxMmap = nil
+	}
+	if idx.packMmap != nil {
+		if e := idx.packMmap.Unmap(); e != nil && err == nil {
+			err = e
+		}
+		idx.packMmap = nil
+	}
+	idx.shaTable, idx.offsetTable, idx.offset8Table, idx.crcTable, idx.packChecksum = nil, nil, nil, nil, nil
+	return err
+}
+
+// Return the position of target in shaTable, a sorted table of object ids
+// of length hashSize with the given fanout table (as in idx and
+// multi-pack-index files). An object id of another length is never found.
+func searchSHA(fanoutTable *[256]int64, shaTable []byte, hashSize int, target []byte) (int64, bool) {
+	if len(target) != hashSize {
+		return 0, false
+	}
 	// Restrict search between shas that start with the correct
 	// byte, thanks to the fanoutTable.
 	var startSearch int64
 	if target[0] > 0 {
-		startSearch = idx.fanoutTable[target[0]-1]
+		startSearch = fanoutTable[target[0]-1]
 	}
-	endSearch := idx.fanoutTable[target[0]]
+	endSearch := fanoutTable[target[0]]
 
 	// Search for the position of the target sha1.
 	var exactMatch bool
 	found := sort.Search(int(endSearch-startSearch), func(i int) bool {
-		cpos := (startSearch + int64(i)) * 20
-		comp := bytes.Compare(target[:], idx.shaTable[cpos:cpos+20])
+		cpos := (startSearch + int64(i)) * int64(hashSize)
+		comp := bytes.Compare(target, shaTable[cpos:cpos+int64(hashSize)])
 		if comp == 0 {
 			exactMatch = true
 		}
 		return comp <= 0
 	})
-	if !exactMatch {
+	return startSearch + int64(found), exactMatch
+}
+
+func (idx *idxFile) offsetForSHA(target []byte) uint64 {
+	n, found := searchSHA(&idx.fanoutTable, idx.shaTable, idx.hashSize, target)
+	if !found {
 		return 0
 	}
+	return idx.offsetAt(n)
+}
 
-	// We found it, now read value
-	pos := (startSearch + int64(found)) * 4
+// Return the offset in the pack file of object number n in the idx file
+// or 0 if the offset is invalid.
+func (idx *idxFile) offsetAt(n int64) uint64 {
+	pos := n * 4
 	offset32 := binary.BigEndian.Uint32(idx.offsetTable[pos : pos+4])
 	offset := uint64(offset32)
 
 	// If msb is set, offset is actually an index into the "big" table where each
-	// offset is 8 bytes instead of 4 bytes.
-	if offset&0x80000000 == 0x80000000 {
+	// offset is 8 bytes instead of 4 bytes. Version 1 idx files have no such
+	// table.
+	if idx.version == 2 && offset&0x80000000 == 0x80000000 {
 		pos := int64(offset&0x7FFFFFFF) * 8
+		if pos+8 > int64(len(idx.offset8Table)) {
+			return 0
+		}
 		offset = binary.BigEndian.Uint64(idx.offset8Table[pos : pos+8])
 	}
 
@@ -179,27 +473,31 @@ func (idx *idxFile) offsetForSHA(target SHA1) uint64 {
 }
 
 // If the object is stored in its own file (i.e not in a pack file),
-// this function returns the full path to the object file.
-// It does not test if the file exists.
-func filepathFromSHA1(rootdir, sha1 string) string {
-	return filepath.Join(rootdir, "objects", sha1[:2], sha1[2:])
+// this function returns the full path to the object file in the objects
+// directory objectsdir. It does not test if the file exists.
+func filepathFromSHA1(objectsdir, sha1 string) string {
+	return filepath.Join(objectsdir, sha1[:2], sha1[2:])
 }
 
 // zlibReaderPool holds zlib Readers.
 var zlibReaderPool sync.Pool
 
-// Read deflated object from the file.
-func readCompressedDataFromFile(file *os.File, start int64, inflatedSize int64) ([]byte, error) {
-	_, err := file.Seek(start, os.SEEK_SET)
-	if err != nil {
-		return nil, err
+// Read deflated object from the pack data.
+func readCompressedData(pack []byte, start int64, inflatedSize int64) ([]byte, error) {
+	if start < 0 || start >= int64(len(pack)) {
+		return nil, errors.New("object position outside of pack file")
 	}
+	if inflatedSize < 0 || inflatedSize/maxDeflateRatio > int64(len(pack))-start {
+		return nil, fmt.Errorf("invalid object size %d in pack file", inflatedSize)
+	}
+	r := bytes.NewReader(pack[start:])
 
+	var err error
 	z := zlibReaderPool.Get()
 	if z != nil {
-		err = z.(zlib.Resetter).Reset(file, nil)
+		err = z.(zlib.Resetter).Reset(r, nil)
 	} else {
-		z, err = zlib.NewReader(file)
+		z, err = zlib.NewReader(r)
 	}
 	if z != nil {
 		defer zlibReaderPool.Put(z)
@@ -216,26 +514,36 @@ func readCompressedDataFromFile(file *os.File, start int64, inflatedSize int64)
 	return zbuf, nil
 }
 
-// buf must be large enough to read the number.
+// Read a little endian base 128 number (7 bits per byte, bit 8 is set if
+// more bytes follow) from buf. Return the number and the number of bytes
+// read, which is 0 if buf ends before the number does or if the number
+// doesn't fit into an int64.
 func readLittleEndianBase128Number(buf []byte) (int64, int) {
-	zpos := 0
-	toread := int64(buf[zpos] & 0x7f)
-	shift := uint64(0)
-	for buf[zpos]&0x80 > 0 {
-		zpos += 1
+	var num int64
+	var shift uint
+	for i, b := range buf {
+		if shift > 56 {
+			return 0, 0
+		}
+		num |= int64(b&0x7f) << shift
 		shift += 7
-		toread |= int64(buf[zpos]&0x7f) << shift
+		if b&0x80 == 0 {
+			return num, i + 1
+		}
 	}
-	zpos += 1
-	return toread, zpos
+	return 0, 0
 }
 
 // We take “delta instructions”, a base object, the expected length
-// of the resulting object and we can create a resulting object.
+// of the resulting object and we can create a resulting object. The
+// instructions must create exactly resultLen bytes.
 func applyDelta(b []byte, base []byte, resultLen int64) ([]byte, error) {
+	// A copy instruction of one byte creates at most 64KB.
+	if resultLen < 0 || resultLen/(1<<16) > int64(len(b)) {
+		return nil, fmt.Errorf("invalid delta result length %d", resultLen)
+	}
 	resultObject := make([]byte, resultLen)
 	var resultpos uint64
-	var basepos uint64
 	zpos := 0
 	for zpos < len(b) {
 		// two modes: copy and insert. copy reads offset and len from the delta
@@ -250,19 +558,19 @@ func applyDelta(b []byte, base []byte, resultLen int64) ([]byte, error) {
 			copy_offset := uint64(0)
 			copy_length := uint64(0)
 			shift := uint(0)
-			for i := 0; i < 4; i++ {
-				if opcode&0x01 > 0 {
-					copy_offset |= uint64(b[zpos]) << shift
-					zpos += 1
+			for i := 0; i < 7; i++ {
+				if i == 4 {
+					shift = 0
 				}
-				opcode >>= 1
-				shift += 8
-			}
-
-			shift = 0
-			for i := 0; i < 3; i++ {
 				if opcode&0x01 > 0 {
-					copy_length |= uint64(b[zpos]) << shift
+					if zpos >= len(b) {
+						return nil, errors.New("delta instruction truncated")
+					}
+					if i < 4 {
+						copy_offset |= uint64(b[zpos]) << shift
+					} else {
+						copy_length |= uint64(b[zpos]) << shift
+					}
 					zpos += 1
 				}
 				opcode >>= 1
@@ -271,185 +579,372 @@ func applyDelta(b []byte, base []byte, resultLen int64) ([]byte, error) {
 			if copy_length == 0 {
 				copy_length = 1 << 16
 			}
-			basepos = copy_offset
-			for i := uint64(0); i < copy_length; i++ {
-				resultObject[resultpos] = base[basepos]
-				resultpos++
-				basepos++
+			if copy_offset+copy_length > uint64(len(base)) {
+				return nil, errors.New("delta copy outside of the base object")
+			}
+			if resultpos+copy_length > uint64(resultLen) {
+				return nil, errors.New("delta result exceeds the declared length")
 			}
+			copy(resultObject[resultpos:], base[copy_offset:copy_offset+copy_length])
+			resultpos += copy_length
 		} else if opcode > 0 {
 			// insert n bytes at the end of the resulting object. n==opcode
-			for i := 0; i < int(opcode); i++ {
-				resultObject[resultpos] = b[zpos]
-				resultpos++
-				zpos++
+			n := int(opcode)
+			if zpos+n > len(b) {
+				return nil, errors.New("delta instruction truncated")
 			}
+			if resultpos+uint64(n) > uint64(resultLen) {
+				return nil, errors.New("delta result exceeds the declared length")
+			}
+			copy(resultObject[resultpos:], b[zpos:zpos+n])
+			resultpos += uint64(n)
+			zpos += n
 		} else {
 			return nil, fmt.Errorf("opcode == 0")
 		}
 	}
-	// TODO: check if resultlen == resultpos
+	if resultpos != uint64(resultLen) {
+		return nil, fmt.Errorf("delta result has %d bytes, expected %d", resultpos, resultLen)
+	}
 	return resultObject, nil
 }
 
 // The object length in a packfile is a bit more difficult than
 // just reading the bytes. The first byte has the length in its
 // lowest four bits, and if bit 7 is set, it means 'more' bytes
-// will follow. These are added to the »left side« of the length
+// will follow. These are added to the »left side« of the length.
+// advance is 0 if buf ends before the length does or if the length
+// doesn't fit into an int.
 func readLenInPackFile(buf []byte) (length int, advance int) {
-	advance = 0
-	shift := [...]byte{0, 4, 11, 18, 25, 32, 39, 46, 53, 60}
-	length = int(buf[advance] & 0x0F)
+	if len(buf) == 0 {
+		return 0, 0
+	}
+	length = int(buf[0] & 0x0F)
+	shift := uint(4)
 	for buf[advance]&0x80 > 0 {
 		advance += 1
-		length += (int(buf[advance]&0x7F) << shift[advance])
+		if advance >= len(buf) || shift > 53 {
+			return 0, 0
+		}
+		length += int(buf[advance]&0x7F) << shift
+		shift += 7
+	}
+	if length < 0 {
+		return 0, 0
 	}
 	advance++
 	return
 }
 
-// Read from a pack file (given by path) at position offset. If this is a
-// non-delta object, the (inflated) bytes are just returned, if the object
-// is a deltafied-object, we have to apply the delta to base objects
-// before hand.
-func readObjectBytes(path string, offset uint64, sizeonly bool) (ot ObjectType, length int64, data []byte, err error) {
-	offsetInt := int64(offset)
-	file, err := os.Open(path)
-	if err != nil {
-		return
-	}
-	defer file.Close()
-	pos, err := file.Seek(offsetInt, os.SEEK_SET)
-	if err != nil {
-		return
-	}
-	if pos != offsetInt {
-		err = errors.New("Seek went wrong")
-		return
-	}
-	buf := make([]byte, 1024)
-	n, err := file.Read(buf)
-	if err != nil {
-		if err == io.EOF && n > 0 {
-			// Ignore EOF error and move on
-			err = nil
-		} else {
-			return
-		}
-	}
-	if n == 0 {
-		err = errors.New("Nothing read from pack file")
-		return
+// A packEntry is the header of an object in a pack file. For deltified
+// objects it also contains the position of the base object, either as an
+// offset in the same pack file (OFS_DELTA) or as an object id (REF_DELTA).
+type packEntry struct {
+	ot      ObjectType
+	length  int64
+	datapos int64 // start of the compressed data
+
+	baseOffset uint64
+	baseOid    *Oid
+}
+
+const (
+	objectOfsDelta ObjectType = 0x60
+	objectRefDelta ObjectType = 0x70
+)
+
+// Read the header of the object at position offset in the pack data.
+// hashSize is the length of the base object id of REF_DELTA objects.
+func readPackEntry(pack []byte, offset int64, hashSize int) (*packEntry, error) {
+	if offset < 0 || offset >= int64(len(pack)) {
+		return nil, errors.New("object position outside of pack file")
 	}
-	ot = ObjectType(buf[0] & 0x70)
+	buf := pack[offset:]
+	entry := &packEntry{}
+	entry.ot = ObjectType(buf[0] & 0x70)
 
 	l, p := readLenInPackFile(buf)
-	pos = int64(p)
-	length = int64(l)
+	if p == 0 {
+		return nil, errors.New("pack entry header truncated")
+	}
+	pos := int64(p)
+	entry.length = int64(l)
 
-	var baseObjectOffset uint64
-	switch ot {
+	switch entry.ot {
 	case ObjectCommit, ObjectTree, ObjectBlob, ObjectTag:
-		if sizeonly {
-			// if we are only interested in the size of the object,
-			// we don't need to do more expensive stuff
-			return
-		}
-
-		data, err = readCompressedDataFromFile(file, offsetInt+pos, length)
-		return
-	case 0x60:
+	case objectOfsDelta:
 		// DELTA_ENCODED object w/ offset to base
 		// Read the offset first, then calculate the starting point
 		// of the base object
+		if pos >= int64(len(buf)) {
+			return nil, errors.New("OFS_DELTA base offset truncated")
+		}
 		num := int64(buf[pos]) & 0x7f
 		for buf[pos]&0x80 > 0 {
 			pos = pos + 1
+			if pos >= int64(len(buf)) || num > 1<<55 {
+				return nil, errors.New("OFS_DELTA base offset truncated")
+			}
 			num = ((num + 1) << 7) | int64(buf[pos]&0x7f)
 		}
-		baseObjectOffset = uint64(offsetInt - num)
+		if num == 0 || num > offset {
+			return nil, errors.New("OFS_DELTA base offset outside of pack file")
+		}
+		entry.baseOffset = uint64(offset - num)
 		pos = pos + 1
-	case 0x70:
+	case objectRefDelta:
 		// DELTA_ENCODED object w/ base BINARY_OBJID
-		err = fmt.Errorf("not implemented yet")
-		return
+		// The bytes following the header are the object id of the base object
+		end := pos + int64(hashSize)
+		if int64(len(buf)) < end {
+			return nil, errors.New("REF_DELTA base id truncated")
+		}
+		var err error
+		entry.baseOid, err = NewOid(buf[pos:end])
+		if err != nil {
+			return nil, err
+		}
+		pos = end
+	default:
+		return nil, fmt.Errorf("unknown object type %d in pack file", entry.ot)
 	}
-	var base []byte
-	ot, _, base, err = readObjectBytes(path, baseObjectOffset, false)
-	if err != nil {
-		return
+	entry.datapos = offset + pos
+	return entry, nil
+}
+
+// Return type and contents of the base object of a deltified pack entry.
+// Bases of REF_DELTA objects are looked up in the whole repository, as
+// they might live outside of the pack (thin packs). Bases stored in pack
+// files are kept in the delta base cache. The returned data must not be
+// modified. depth is the number of deltas already resolved above entry.
+func (repos *Repository) readDeltaBase(pack *idxFile, entry *packEntry, depth int) (ObjectType, []byte, error) {
+	if err := repos.checkDeltaDepth(depth + 1); err != nil {
+		return 0, nil, err
+	}
+	basepack, baseoffset := pack, entry.baseOffset
+	if entry.baseOid != nil {
+		var objpath string
+		var err error
+		objpath, basepack, baseoffset, err = repos.findObject(entry.baseOid)
+		if err != nil {
+			return 0, nil, err
+		}
+		if basepack == nil {
+			ot, _, base, err := repos.readObjectFile(objpath, false)
+			return ot, base, err
+		}
 	}
-	b, err := readCompressedDataFromFile(file, offsetInt+pos, length)
+	if ot, base, ok := repos.deltaBaseCache.get(basepack.packpath, baseoffset); ok {
+		return ot, base, nil
+	}
+	ot, _, base, err := repos.readPackedObject(basepack, baseoffset, depth+1)
 	if err != nil {
-		return
+		return 0, nil, err
 	}
-	zpos := 0
-	// This is the length of the base object. Do we need to know it?
-	_, bytesRead := readLittleEndianBase128Number(b)
-	zpos += bytesRead
-	resultObjectLength, bytesRead := readLittleEndianBase128Number(b[zpos:])
-	zpos += bytesRead
+	repos.deltaBaseCache.add(basepack.packpath, baseoffset, ot, base)
+	return ot, base, nil
+}
+
+// Read from a pack file at position offset. If this is a
+// non-delta object, the (inflated) bytes are just returned, if the object
+// is a deltafied-object, we have to apply the delta to base objects
+// before hand.
+func (repos *Repository) readObjectBytes(pack *idxFile, offset uint64, sizeonly bool) (ot ObjectType, length int64, data []byte, err error) {
 	if sizeonly {
 		// if we are only interested in the size of the object,
 		// we don't need to do more expensive stuff
-		length = resultObjectLength
+		ot, length, err = repos.readObjectHeader(pack, offset)
+		return
+	}
+	return repos.readPackedObject(pack, offset, 0)
+}
+
+// Same as readObjectBytes, depth is the number of deltas resolved so far.
+func (repos *Repository) readPackedObject(pack *idxFile, offset uint64, depth int) (ot ObjectType, length int64, data []byte, err error) {
+	entry, err := readPackEntry(pack.packMmap, int64(offset), pack.hashSize)
+	if err != nil {
+		return
+	}
+	ot = entry.ot
+	length = entry.length
+	if err = repos.checkObjectSize(length); err != nil {
 		return
 	}
 
+	switch ot {
+	case ObjectCommit, ObjectTree, ObjectBlob, ObjectTag:
+		data, err = readCompressedData(pack.packMmap, entry.datapos, length)
+		return
+	}
+	b, err := readCompressedData(pack.packMmap, entry.datapos, length)
+	if err != nil {
+		return
+	}
+	baseObjectLength, resultObjectLength, zpos, err := readDeltaLengths(b)
+	if err != nil {
+		return
+	}
+	if err = repos.checkObjectSize(resultObjectLength); err != nil {
+		return
+	}
+	var base []byte
+	ot, base, err = repos.readDeltaBase(pack, entry, depth)
+	if err != nil {
+		return
+	}
+	if int64(len(base)) != baseObjectLength {
+		err = errors.New("delta base object has the wrong size")
+		return
+	}
+	length = resultObjectLength
 	data, err = applyDelta(b[zpos:], base, resultObjectLength)
 	return
 }
 
-// Return length as integer from zero terminated string
-// and the beginning of the real object
-func getLengthZeroTerminated(b []byte) (int64, int64) {
-	i := 0
-	var pos int
-	for b[i] != 0 {
-		i++
+// Read the lengths of the base object and the resulting object at the
+// beginning of the delta data. Return the position after the lengths.
+func readDeltaLengths(b []byte) (baseLength, resultLength int64, pos int, err error) {
+	baseLength, n := readLittleEndianBase128Number(b)
+	if n == 0 {
+		return 0, 0, 0, errors.New("delta header truncated")
+	}
+	resultLength, m := readLittleEndianBase128Number(b[n:])
+	if m == 0 {
+		return 0, 0, 0, errors.New("delta header truncated")
+	}
+	return baseLength, resultLength, n + m, nil
+}
+
+// Return ErrObjectTooLarge if objects of this size must not be read.
+func (repos *Repository) checkObjectSize(size int64) error {
+	if repos.maxObjectSize > 0 && size > repos.maxObjectSize {
+		return ErrObjectTooLarge
+	}
+	return nil
+}
+
+// Return ErrDeltaChainTooDeep if a delta chain must not be longer than
+// depth.
+func (repos *Repository) checkDeltaDepth(depth int) error {
+	max := repos.maxDeltaDepth
+	if max <= 0 {
+		max = defaultMaxDeltaDepth
+	}
+	if depth > max {
+		return ErrDeltaChainTooDeep
+	}
+	return nil
+}
+
+// Return type and size of the object at position offset in the pack file
+// without inflating it. The size of a deltified object is stored at the
+// beginning of the delta data, so only these bytes get inflated. The type
+// is the type of the object at the end of the delta chain, the bases are
+// not inflated either.
+func (repos *Repository) readObjectHeader(pack *idxFile, offset uint64) (ObjectType, int64, error) {
+	entry, err := readPackEntry(pack.packMmap, int64(offset), pack.hashSize)
+	if err != nil {
+		return 0, 0, err
+	}
+	if entry.ot != objectOfsDelta && entry.ot != objectRefDelta {
+		return entry.ot, entry.length, nil
+	}
+	// The delta starts with the length of the base object and the length
+	// of the resulting object, at most 10 bytes each.
+	headerlen := entry.length
+	if headerlen > 20 {
+		headerlen = 20
+	}
+	b, err := readCompressedData(pack.packMmap, entry.datapos, headerlen)
+	if err != nil {
+		return 0, 0, err
+	}
+	_, length, _, err := readDeltaLengths(b)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for depth := 1; entry.ot == objectOfsDelta || entry.ot == objectRefDelta; depth++ {
+		if err = repos.checkDeltaDepth(depth); err != nil {
+			return 0, 0, err
+		}
+		if entry.baseOid != nil {
+			var objpath string
+			objpath, pack, offset, err = repos.findObject(entry.baseOid)
+			if err != nil {
+				return 0, 0, err
+			}
+			if pack == nil {
+				ot, _, _, err := repos.readObjectFile(objpath, true)
+				return ot, length, err
+			}
+		} else {
+			if entry.baseOffset >= offset {
+				return 0, 0, errors.New("delta base offset after delta object")
+			}
+			offset = entry.baseOffset
+		}
+		if entry, err = readPackEntry(pack.packMmap, int64(offset), pack.hashSize); err != nil {
+			return 0, 0, err
+		}
+	}
+	return entry.ot, length, nil
+}
+
+// Return the object length from the decimal number in b, which must be
+// terminated by a zero byte, and the position after the zero byte.
+func getLengthZeroTerminated(b []byte) (int64, int64, error) {
+	zero := bytes.IndexByte(b, 0)
+	if zero <= 0 {
+		return 0, 0, errors.New("object length missing")
 	}
-	pos = i
-	i--
 	var length int64
-	var pow int64
-	pow = 1
-	for i >= 0 {
-		length = length + (int64(b[i])-48)*pow
-		pow = pow * 10
-		i--
+	for _, c := range b[:zero] {
+		if c < '0' || c > '9' || length > (1<<62)/10 {
+			return 0, 0, errors.New("invalid object length")
+		}
+		length = length*10 + int64(c-'0')
 	}
-	return length, int64(pos) + 1
+	return length, int64(zero) + 1, nil
 }
 
-// Read the contents of the object file at path.
-// Return the content type, the contents of the file and error, if any
-func readObjectFile(path string, sizeonly bool) (ot ObjectType, length int64, data []byte, err error) {
-	var file *os.File
-	file, err = os.Open(path)
+// Open the object file at path and read the header ("blob 1234\0").
+// The returned reader is positioned at the beginning of the object data
+// and must be closed by the caller.
+func openObjectFile(path string) (ot ObjectType, length int64, rc io.ReadCloser, err error) {
+	file, err := os.Open(path)
 	if err != nil {
 		return
 	}
-	defer file.Close()
-	r, err := zlib.NewReader(file)
+	fi, err := file.Stat()
 	if err != nil {
+		file.Close()
 		return
 	}
-	defer r.Close()
-	first_buffer_size := int64(1024)
-	b := make([]byte, first_buffer_size)
-	n, err := r.Read(b)
+	z, err := zlib.NewReader(file)
 	if err != nil {
-		if err == io.EOF && n > 0 {
-			// Ignore EOF error on read
-			err = nil
-		} else {
-			return
-		}
+		file.Close()
+		return
+	}
+	br := bufio.NewReader(z)
+	objrc := &objectReadCloser{Reader: br, closers: []io.Closer{z, file}}
+	// The header is short, a missing zero byte within the buffer is an
+	// error (bufio.ErrBufferFull)
+	header, err := br.ReadSlice(0)
+	if err != nil {
+		objrc.Close()
+		err = fmt.Errorf("Malformed object header in %s: %s", path, err)
+		return
+	}
+	spaceposition := bytes.IndexByte(header, ' ')
+	if spaceposition < 0 {
+		objrc.Close()
+		err = errors.New("Malformed object header in " + path)
+		return
 	}
-	spaceposition := int64(bytes.IndexByte(b, ' '))
 
 	// "tree", "commit", "blob", ...
-	objecttypeString := string(b[:spaceposition])
+	objecttypeString := string(header[:spaceposition])
 
 	switch objecttypeString {
 	case "blob":
@@ -460,66 +955,186 @@ func readObjectFile(path string, sizeonly bool) (ot ObjectType, length int64, da
 		ot = ObjectCommit
 	case "tag":
 		ot = ObjectTag
+	default:
+		objrc.Close()
+		err = fmt.Errorf("Unknown object type %q in %s", objecttypeString, path)
+		return
 	}
 
 	// length starts at the position after the space
-	var objstart int64
-	length, objstart = getLengthZeroTerminated(b[spaceposition+1:])
+	length, _, err = getLengthZeroTerminated(header[spaceposition+1:])
+	if err == nil && length/maxDeflateRatio > fi.Size() {
+		err = fmt.Errorf("invalid object length %d", length)
+	}
+	if err != nil {
+		objrc.Close()
+		err = fmt.Errorf("Malformed object header in %s: %s", path, err)
+		return
+	}
+	objrc.Reader = &sizedReader{r: br, remaining: length}
+	rc = objrc
+	return
+}
+
+// Read the contents of the object file at path.
+// Return the content type, the contents of the file and error, if any
+func (repos *Repository) readObjectFile(path string, sizeonly bool) (ot ObjectType, length int64, data []byte, err error) {
+	ot, length, r, err := openObjectFile(path)
+	if err != nil {
+		return
+	}
+	defer r.Close()
 
 	if sizeonly {
 		// if we are only interested in the size of the object,
 		// we don't need to do more expensive stuff
 		return
 	}
+	if err = repos.checkObjectSize(length); err != nil {
+		return
+	}
 
-	objstart += spaceposition + 1
-
-	// if the size of our buffer is less than the object length + the bytes
-	// in front of the object (example: "commit 234\0") we need to increase
-	// the size of the buffer and read the rest. Warning: this should only
-	// be done on small files
-	if int64(n) < length+objstart {
-		remainingSize := length - first_buffer_size + objstart
-		remainingBuf := make([]byte, remainingSize)
-		n = 0
-		var count int64
-		for count < remainingSize {
-			n, err = r.Read(remainingBuf[count:])
-			if err != nil && err != io.EOF {
-				return
-			}
-			count += int64(n)
+	data = make([]byte, length)
+	_, err = io.ReadFull(r, data)
+	return
+}
+
+// Acquire the read lock of the repository for a lookup. Return ErrClosed
+// (without holding the lock) if the repository has been closed.
+func (repos *Repository) rlock() error {
+	repos.mu.RLock()
+	if repos.closed {
+		repos.mu.RUnlock()
+		return ErrClosed
+	}
+	return nil
+}
+
+// Return ErrClosed if the repository has been closed.
+func (repos *Repository) checkOpen() error {
+	repos.mu.RLock()
+	defer repos.mu.RUnlock()
+	if repos.closed {
+		return ErrClosed
+	}
+	return nil
+}
+
+// Run the lookup function f with the read lock held. If f doesn't find
+// the object, the pack directory is read again (see rescanPacks) and if
+// it has changed, f is run once more.
+func (repos *Repository) lookup(f func() error) error {
+	if err := repos.rlock(); err != nil {
+		return err
+	}
+	err := f()
+	repos.mu.RUnlock()
+	if err == errObjNotFound && repos.rescanPacks() {
+		if err = repos.rlock(); err != nil {
+			return err
 		}
-		b = append(b, remainingBuf...)
+		err = f()
+		repos.mu.RUnlock()
+	}
+	return err
+}
+
+// Read the pack directories again and update the lists of pack files,
+// see objectStore.rescanPacks. This is done at most once every
+// packRescanInterval. Return true if a list has changed.
+func (repos *Repository) rescanPacks() bool {
+	repos.mu.Lock()
+	defer repos.mu.Unlock()
+	if repos.closed || repos.packRescanInterval < 0 || time.Since(repos.lastPackScan) < repos.packRescanInterval {
+		return false
 	}
-	data = b[objstart : objstart+length]
-	if err == io.EOF {
-		// The last read yielded exactly the right number of bytes
-		// as well as an EOF. Ignore the EOF; we succeeded.
-		err = nil
+	repos.lastPackScan = time.Now()
+	changed := false
+	for _, store := range repos.stores {
+		if store.rescanPacks() {
+			changed = true
+		}
 	}
+	return changed
+}
+
+func (repos *Repository) getRawObject(oid *Oid) (ot ObjectType, length int64, data []byte, err error) {
+	err = repos.lookup(func() error {
+		ot, length, data, err = repos.readRawObject(oid, false)
+		return err
+	})
 	return
 }
 
-func (repos *Repository) getRawObject(oid *Oid) (ObjectType, int64, []byte, error) {
-	// first we need to find out where the commit is stored
-	objpath := filepathFromSHA1(repos.Path, oid.String())
-	_, err := os.Stat(objpath)
-	if os.IsNotExist(err) {
-		// doesn't exist, let's look if we find the object somewhere else
-		for _, indexfile := range repos.indexfiles {
-			if offset := indexfile.offsetForSHA(oid.Bytes); offset != 0 {
-				return readObjectBytes(indexfile.packpath, offset, false)
-			}
+// Same as getRawObject, but the caller must hold the read lock. If sizeonly
+// is true, the contents of the object are not read.
+func (repos *Repository) readRawObject(oid *Oid, sizeonly bool) (ObjectType, int64, []byte, error) {
+	objpath, pack, offset, err := repos.findObject(oid)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if pack != nil {
+		return repos.readObjectBytes(pack, offset, sizeonly)
+	}
+	return repos.readObjectFile(objpath, sizeonly)
+}
+
+// Same as getRawObject, but return a reader for the contents instead of
+// the contents itself. The caller must close the reader.
+func (repos *Repository) getObjectReader(oid *Oid) (ot ObjectType, length int64, rc io.ReadCloser, err error) {
+	err = repos.lookup(func() error {
+		ot, length, rc, err = repos.openObjectReader(oid)
+		return err
+	})
+	return
+}
+
+func (repos *Repository) openObjectReader(oid *Oid) (ObjectType, int64, io.ReadCloser, error) {
+	objpath, pack, offset, err := repos.findObject(oid)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if pack != nil {
+		return repos.readObjectStream(pack, offset)
+	}
+	ot, length, rc, err := openObjectFile(objpath)
+	if err == nil {
+		if err = repos.checkObjectSize(length); err != nil {
+			rc.Close()
+			return 0, 0, nil, err
 		}
-		return 0, 0, nil, errObjNotFound
 	}
-	return readObjectFile(objpath, false)
+	return ot, length, rc, err
 }
 
 // Open the repository at the given path.
 func OpenRepository(path string) (*Repository, error) {
+	return OpenRepositoryWithOptions(path, nil)
+}
+
+// Open the repository at the given path with non-default settings. opts
+// may be nil.
+func OpenRepositoryWithOptions(path string, opts *RepositoryOptions) (*Repository, error) {
+	if opts == nil {
+		opts = &RepositoryOptions{}
+	}
 	root := new(Repository)
+	switch {
+	case opts.DeltaBaseCacheLimit == 0:
+		root.deltaBaseCache = newDeltaBaseCache(defaultDeltaBaseCacheLimit)
+	case opts.DeltaBaseCacheLimit > 0:
+		root.deltaBaseCache = newDeltaBaseCache(opts.DeltaBaseCacheLimit)
+	}
+	if opts.ObjectCacheSize > 0 {
+		root.objectCache = newObjectCache(opts.ObjectCacheSize)
+	}
+	root.packRescanInterval = opts.PackRescanInterval
+	if root.packRescanInterval == 0 {
+		root.packRescanInterval = defaultPackRescanInterval
+	}
+	root.lastPackScan = time.Now()
+	root.maxObjectSize = opts.MaxObjectSize
+	root.maxDeltaDepth = opts.MaxDeltaDepth
 	path, err := filepath.Abs(path)
 	if err != nil {
 		return nil, err
@@ -530,28 +1145,140 @@ func OpenRepository(path string) (*Repository, error) {
 		return nil, err
 	}
 	if !fm.IsDir() {
-		return nil, errors.New(fmt.Sprintf("%q is not a directory."))
+		return nil, errors.New(fmt.Sprintf("%q is not a directory.", path))
+	}
+	config, err := readConfig(filepath.Join(path, "config"))
+	if err != nil {
+		return nil, err
+	}
+	if root.hash, err = hashAlgorithmFromConfig(config); err != nil {
+		return nil, err
 	}
 
-	indexfiles, err := filepath.Glob(filepath.Join(path, "objects/pack/*.idx"))
+	seen := make(map[string]bool)
+	err = root.addObjectStore(filepath.Join(path, "objects"), 0, seen)
+	for i := 0; err == nil && i < len(opts.AlternateObjectDirectories); i++ {
+		var dir string
+		if dir, err = filepath.Abs(opts.AlternateObjectDirectories[i]); err == nil {
+			err = root.addObjectStore(dir, 1, seen)
+		}
+	}
 	if err != nil {
+		root.Close()
 		return nil, err
 	}
-	root.indexfiles = make([]*idxFile, len(indexfiles))
-	for i, indexfile := range indexfiles {
-		idx, err := readIdxFile(indexfile)
+	// The commit-graph only speeds up history walks, without it (or with
+	// a broken one) the commit objects are read instead.
+	root.commitGraph, _ = readCommitGraph(filepath.Join(path, "objects"), root.hash)
+
+	return root, nil
+}
+
+// Release the memory mapped pack and idx files of the repository. Close
+// waits for running lookups to finish, subsequent lookups return
+// ErrClosed. Readers returned by BlobReader stay valid until they are
+// closed. Calling Close more than once is a no-op.
+func (repos *Repository) Close() error {
+	repos.mu.Lock()
+	defer repos.mu.Unlock()
+	if repos.closed {
+		return nil
+	}
+	repos.closed = true
+	repos.deltaBaseCache.close()
+	repos.objectCache.close()
+	var err error
+	for _, store := range repos.stores {
+		if e := store.close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	if repos.commitGraph != nil {
+		if e := repos.commitGraph.close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Return the hash algorithm of the object ids in the repository.
+func (repos *Repository) HashAlgorithm() HashAlgorithm {
+	return repos.hash
+}
+
+// Return true if the object exists in the repository. The object is not
+// read.
+func (repos *Repository) HasObject(oid *Oid) (bool, error) {
+	err := repos.lookup(func() error {
+		_, _, _, err := repos.findObject(oid)
+		return err
+	})
+	if err == errObjNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Call fn for every object in the repository (including the objects in
+// alternate object directories) with its id and type. Objects stored more
+// than once (loose and packed or in several pack files) are reported only
+// once. The objects are visited in the order of their ids. The list of
+// objects is read before the first call of fn, objects added later are not
+// reported, and objects removed in the meantime are skipped. If fn returns
+// an error, the iteration stops and ForEachObject returns this error.
+func (repos *Repository) ForEachObject(fn func(oid *Oid, ot ObjectType) error) error {
+	seen := make(map[string]bool)
+	var oids []*Oid
+	err := repos.lookup(func() error {
+		for _, store := range repos.stores {
+			err := store.forEachOid(func(sha []byte) {
+				if !seen[string(sha)] {
+					seen[string(sha)] = true
+					oids = append(oids, &Oid{Bytes: append([]byte(nil), sha...)})
+				}
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	seen = nil
+	sort.Slice(oids, func(i, j int) bool {
+		return bytes.Compare(oids[i].Bytes, oids[j].Bytes) < 0
+	})
+	for _, oid := range oids {
+		ot, _, err := repos.Header(oid)
+		if err == errObjNotFound {
+			continue
+		}
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if err = fn(oid, ot); err != nil {
+			return err
 		}
-		root.indexfiles[i] = idx
 	}
+	return nil
+}
 
-	return root, nil
+// Get type and (inflated) size of an object without reading its
+// contents. For deltified objects, neither the delta nor its base objects
+// are inflated.
+func (repos *Repository) Header(oid *Oid) (ot ObjectType, length int64, err error) {
+	err = repos.lookup(func() error {
+		ot, length, _, err = repos.readRawObject(oid, true)
+		return err
+	})
+	return
 }
 
 // Get the type of an object.
 func (repos *Repository) Type(oid *Oid) (ObjectType, error) {
-	objtype, _, _, err := repos.getRawObject(oid)
+	objtype, _, err := repos.Header(oid)
 	if err != nil {
 		return 0, err
 	}
@@ -560,22 +1287,6 @@ func (repos *Repository) Type(oid *Oid) (ObjectType, error) {
 
 // Get (inflated) size of an object.
 func (repos *Repository) ObjectSize(oid *Oid) (int64, error) {
-
-	// todo: this is mostly the same as getRawObject -> merge
-	// difference is the boolean in readObjectBytes and readObjectFile
-	objpath := filepathFromSHA1(repos.Path, oid.String())
-	_, err := os.Stat(objpath)
-	if os.IsNotExist(err) {
-		// doesn't exist, let's look if we find the object somewhere else
-		for _, indexfile := range repos.indexfiles {
-			if offset := indexfile.offsetForSHA(oid.Bytes); offset != 0 {
-				_, length, _, err := readObjectBytes(indexfile.packpath, offset, true)
-				return length, err
-			}
-		}
-
-		return 0, errors.New("Object not found")
-	}
-	_, length, _, err := readObjectFile(objpath, true)
+	_, length, err := repos.Header(oid)
 	return length, err
 }
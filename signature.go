@@ -22,7 +22,10 @@ package gogit
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -37,20 +40,69 @@ type Signature struct {
 //     author Patrick Gundlach <gundlach@speedata.de> 1378823654 +0200
 // but without the "author " at the beginning (this method should)
 // be used for author and committer.
-//
-// FIXME: include timezone!
 func newSignatureFromCommitline(line []byte) (*Signature, error) {
 	sig := new(Signature)
 	emailstart := bytes.IndexByte(line, '<')
-	sig.Name = string(line[:emailstart-1])
 	emailstop := bytes.IndexByte(line, '>')
+	if emailstart < 1 || emailstop < emailstart || emailstop+2 > len(line) {
+		return nil, errors.New("Malformed signature: " + string(line))
+	}
+	sig.Name = string(line[:emailstart-1])
 	sig.Email = string(line[emailstart+1 : emailstop])
-	timestop := bytes.IndexByte(line[emailstop+2:], ' ')
-	timestring := string(line[emailstop+2 : emailstop+2+timestop])
-	seconds, err := strconv.ParseInt(timestring, 10, 64)
+	timestring := line[emailstop+2:]
+	var zone []byte
+	if timestop := bytes.IndexByte(timestring, ' '); timestop >= 0 {
+		timestring, zone = timestring[:timestop], timestring[timestop+1:]
+	}
+	seconds, err := strconv.ParseInt(string(timestring), 10, 64)
 	if err != nil {
 		return nil, err
 	}
 	sig.When = time.Unix(seconds, 0)
+	if loc := parseTimezone(zone); loc != nil {
+		sig.When = sig.When.In(loc)
+	}
 	return sig, nil
 }
+
+// Return the location for a time zone such as "+0200" or nil if zone
+// is malformed.
+func parseTimezone(zone []byte) *time.Location {
+	if len(zone) != 5 || (zone[0] != '+' && zone[0] != '-') {
+		return nil
+	}
+	hhmm, err := strconv.Atoi(string(zone[1:]))
+	if err != nil || hhmm%100 >= 60 {
+		return nil
+	}
+	offset := (hhmm/100*60 + hhmm%100) * 60
+	if zone[0] == '-' {
+		offset = -offset
+	}
+	return time.FixedZone("", offset)
+}
+
+// Return the signature in the form used in commit and tag objects:
+//     Patrick Gundlach <gundlach@speedata.de> 1378823654 +0200
+func (sig *Signature) commitline() string {
+	_, offset := sig.When.Zone()
+	sign := '+'
+	if offset < 0 {
+		sign = '-'
+		offset = -offset
+	}
+	offset /= 60
+	return fmt.Sprintf("%s <%s> %d %c%02d%02d", sig.Name, sig.Email, sig.When.Unix(), sign, offset/60, offset%60)
+}
+
+// Return an error if the signature can't be written to a commit or tag
+// object.
+func (sig *Signature) validate() error {
+	if sig == nil {
+		return errors.New("Missing signature")
+	}
+	if strings.ContainsAny(sig.Name, "<>\n") || strings.ContainsAny(sig.Email, "<>\n") {
+		return errors.New("Invalid character in signature: " + sig.Name + " <" + sig.Email + ">")
+	}
+	return nil
+}
@@ -0,0 +1,259 @@
+// Copyright (c) 2013 Patrick Gundlach, speedata (Berlin, Germany)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gogit
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"io"
+)
+
+// An objectReadCloser reads the contents of an object and closes the
+// underlying zlib readers and files on Close.
+type objectReadCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (o *objectReadCloser) Close() error {
+	var err error
+	for _, c := range o.closers {
+		if e := c.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// A sizedReader reads an object of remaining bytes from r. A stream that
+// ends early is an io.ErrUnexpectedEOF, a stream with more data than the
+// declared size is an error as well.
+type sizedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (s *sizedReader) Read(p []byte) (int, error) {
+	if s.remaining == 0 {
+		// The stream has to end here
+		var b [1]byte
+		for {
+			n, err := s.r.Read(b[:])
+			if n > 0 {
+				return 0, errors.New("object has more data than its declared size")
+			}
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	if int64(len(p)) > s.remaining {
+		p = p[:s.remaining]
+	}
+	n, err := s.r.Read(p)
+	s.remaining -= int64(n)
+	if err == io.EOF {
+		if s.remaining > 0 {
+			return n, io.ErrUnexpectedEOF
+		}
+		err = nil
+	}
+	return n, err
+}
+
+// A deltaReader creates the resulting object from the delta instructions
+// and the base object while reading. Only the base object has to be kept
+// in memory, the result is never materialized.
+type deltaReader struct {
+	delta     *bufio.Reader
+	base      []byte
+	remaining int64  // bytes of the result not covered by an instruction yet
+	copybuf   []byte // bytes of the current copy instruction not read yet
+	insert    int    // bytes of the current insert instruction not read yet
+}
+
+func (d *deltaReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		switch {
+		case len(d.copybuf) > 0:
+			c := copy(p[n:], d.copybuf)
+			d.copybuf = d.copybuf[c:]
+			n += c
+		case d.insert > 0:
+			want := d.insert
+			if want > len(p)-n {
+				want = len(p) - n
+			}
+			c, err := io.ReadFull(d.delta, p[n:n+want])
+			n += c
+			d.insert -= c
+			if err != nil {
+				return n, io.ErrUnexpectedEOF
+			}
+		default:
+			opcode, err := d.delta.ReadByte()
+			if err == io.EOF {
+				if d.remaining != 0 {
+					return n, errors.New("delta instructions end before the resulting object is complete")
+				}
+				if n == 0 {
+					return 0, io.EOF
+				}
+				return n, nil
+			}
+			if err != nil {
+				return n, err
+			}
+			if err = d.nextInstruction(opcode); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Read the arguments of the delta instruction opcode (see applyDelta).
+func (d *deltaReader) nextInstruction(opcode byte) error {
+	if opcode&0x80 == 0 {
+		if opcode == 0 {
+			return errors.New("opcode == 0")
+		}
+		if int64(opcode) > d.remaining {
+			return errors.New("delta insert exceeds the resulting object")
+		}
+		d.insert = int(opcode)
+		d.remaining -= int64(opcode)
+		return nil
+	}
+	var copyOffset, copyLength uint64
+	for i := uint(0); i < 7; i++ {
+		if opcode&(1<<i) == 0 {
+			continue
+		}
+		b, err := d.delta.ReadByte()
+		if err != nil {
+			return io.ErrUnexpectedEOF
+		}
+		if i < 4 {
+			copyOffset |= uint64(b) << (8 * i)
+		} else {
+			copyLength |= uint64(b) << (8 * (i - 4))
+		}
+	}
+	if copyLength == 0 {
+		copyLength = 1 << 16
+	}
+	if copyOffset+copyLength > uint64(len(d.base)) || int64(copyLength) > d.remaining {
+		return errors.New("delta copy out of range")
+	}
+	d.copybuf = d.base[copyOffset : copyOffset+copyLength]
+	d.remaining -= int64(copyLength)
+	return nil
+}
+
+// Same as readLittleEndianBase128Number, but read from r.
+func readLittleEndianBase128Reader(r io.ByteReader) (int64, error) {
+	var num int64
+	var shift uint
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if shift > 56 {
+			return 0, errors.New("number too large")
+		}
+		num |= int64(b&0x7f) << shift
+		shift += 7
+		if b&0x80 == 0 {
+			return num, nil
+		}
+	}
+}
+
+// A closerFunc turns a function into an io.Closer.
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
+
+// Return a reader for the object at position offset in the pack file.
+// Non-delta objects are inflated while reading. For deltified objects the
+// base object is read into memory, the delta is applied while reading.
+// The pack file stays mapped until the reader is closed.
+func (repos *Repository) readObjectStream(pack *idxFile, offset uint64) (ot ObjectType, length int64, rc io.ReadCloser, err error) {
+	if !pack.acquire() {
+		err = errors.New("pack file is closed")
+		return
+	}
+	defer func() {
+		if err != nil {
+			pack.release()
+		}
+	}()
+	entry, err := readPackEntry(pack.packMmap, int64(offset), pack.hashSize)
+	if err != nil {
+		return
+	}
+	ot = entry.ot
+	length = entry.length
+	if err = repos.checkObjectSize(length); err != nil {
+		return
+	}
+	deltified := ot == objectOfsDelta || ot == objectRefDelta
+	var base []byte
+	if deltified {
+		ot, base, err = repos.readDeltaBase(pack, entry, 0)
+		if err != nil {
+			return
+		}
+	}
+	z, err := zlib.NewReader(bytes.NewReader(pack.packMmap[entry.datapos:]))
+	if err != nil {
+		return
+	}
+	if !deltified {
+		rc = &objectReadCloser{Reader: &sizedReader{r: z, remaining: length}, closers: []io.Closer{z, closerFunc(pack.release)}}
+		return
+	}
+	br := bufio.NewReader(z)
+	var baseLength int64
+	if baseLength, err = readLittleEndianBase128Reader(br); err == nil {
+		length, err = readLittleEndianBase128Reader(br)
+	}
+	if err == nil && baseLength != int64(len(base)) {
+		err = errors.New("delta base object has the wrong size")
+	}
+	if err == nil {
+		err = repos.checkObjectSize(length)
+	}
+	if err != nil {
+		z.Close()
+		return
+	}
+	dr := &deltaReader{delta: br, base: base, remaining: length}
+	rc = &objectReadCloser{Reader: dr, closers: []io.Closer{z, closerFunc(pack.release)}}
+	return
+}
@@ -23,6 +23,7 @@ package gogit
 import (
 	"bytes"
 	"errors"
+	"fmt"
 )
 
 // Who am I?
@@ -30,6 +31,9 @@ type TagType int
 
 const (
 	TagCommit TagType = iota
+	TagTree
+	TagBlob
+	TagTag
 )
 
 type Tag struct {
@@ -55,38 +59,60 @@ func parseTagData(data []byte) (*Tag, error) {
 	if !bytes.HasPrefix(data, []byte("object ")) {
 		return nil, errors.New("This is not a Tag object, it doesn't start with 'object '")
 	}
-	// We know now that we have a tag object. So we can assume the
-	// datastructure is fixed (keep fingers crossed!)
-	tag.TargetId, err = NewOidFromByteString(data[7:47])
+	// Return the value of the next header line, which must start with
+	// the keyword.
+	rest := data
+	header := func(keyword string) ([]byte, error) {
+		eol := bytes.IndexByte(rest, '\n')
+		if eol < 0 || !bytes.HasPrefix(rest, []byte(keyword+" ")) {
+			return nil, errors.New("Malformed tag object, missing '" + keyword + "'")
+		}
+		value := rest[len(keyword)+1 : eol]
+		rest = rest[eol+1:]
+		return value, nil
+	}
+
+	// The object id has 40 (SHA-1) or 64 (SHA-256) hex digits.
+	value, err := header("object")
 	if err != nil {
 		return nil, err
 	}
-	// 6 = "\ntype "
-	pos := 47 + 6
-	nlpos := bytes.IndexByte(data[pos:], '\n')
-	committype := string(data[pos : pos+nlpos])
+	tag.TargetId, err = NewOidFromByteString(value)
+	if err != nil {
+		return nil, err
+	}
+	if value, err = header("type"); err != nil {
+		return nil, err
+	}
+	committype := string(value)
 	switch committype {
 	case "commit":
 		tag.Type = TagCommit
+	case "tree":
+		tag.Type = TagTree
+	case "blob":
+		tag.Type = TagBlob
+	case "tag":
+		tag.Type = TagTag
 	default:
 		return nil, errors.New("Unknown Tag type: " + committype)
 	}
-	// 5 = "\ntag "
-	pos += nlpos + 5
-
-	nlpos = bytes.IndexByte(data[pos:], '\n')
-	tag.Name = string(data[pos : pos+nlpos])
-
-	// 8 = "\ntagger "
-	pos += nlpos + 8
-	nlpos = bytes.IndexByte(data[pos:], '\n')
-	tag.Tagger, err = newSignatureFromCommitline(data[pos : pos+nlpos])
+	if value, err = header("tag"); err != nil {
+		return nil, err
+	}
+	tag.Name = string(value)
+	if value, err = header("tagger"); err != nil {
+		return nil, err
+	}
+	tag.Tagger, err = newSignatureFromCommitline(value)
 	if err != nil {
 		return nil, err
 	}
 
-	pos += nlpos + 2
-	tag.Message = string(data[pos:])
+	// An empty line separates the message
+	if len(rest) > 0 {
+		tag.Message = string(rest[1:])
+	}
 	return tag, nil
 }
 
@@ -103,3 +129,60 @@ func (repos *Repository) LookupTag(oid *Oid) (*Tag, error) {
 	tag.repository = repos
 	return tag, nil
 }
+
+// Return the object type of the tagged object.
+func (t TagType) objectType() ObjectType {
+	switch t {
+	case TagTree:
+		return ObjectTree
+	case TagBlob:
+		return ObjectBlob
+	case TagTag:
+		return ObjectTag
+	default:
+		return ObjectCommit
+	}
+}
+
+// Return the id of the object of type t reached from oid by following
+// tags. A commit peels to its tree.
+func (repos *Repository) peel(oid *Oid, t ObjectType) (*Oid, error) {
+	seen := make(map[string]bool)
+	for {
+		ot, _, err := repos.Header(oid)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case ot == t:
+			return oid, nil
+		case ot == ObjectTag && !seen[oid.key()]:
+			// A tag can point to another tag. A loop is only possible
+			// in a corrupt repository.
+			seen[oid.key()] = true
+			tag, err := repos.LookupTag(oid)
+			if err != nil {
+				return nil, err
+			}
+			oid = tag.TargetId
+		case ot == ObjectCommit && t == ObjectTree:
+			ci, err := repos.LookupCommitNode(oid)
+			if err != nil {
+				return nil, err
+			}
+			return ci.TreeId(), nil
+		default:
+			return nil, fmt.Errorf("cannot peel %s %s to %s", ot.headerName(), oid, t.headerName())
+		}
+	}
+}
+
+// Return the commit oid points to: oid itself if it is a commit, or the
+// commit at the end of a chain of tags. Other objects are an error.
+func (repos *Repository) PeelToCommit(oid *Oid) (*Commit, error) {
+	commitId, err := repos.peel(oid, ObjectCommit)
+	if err != nil {
+		return nil, err
+	}
+	return repos.LookupCommit(commitId)
+}
@@ -52,8 +52,8 @@ const (
 )
 
 // Parse tree information from the (uncompressed) raw
-// data from the tree object.
-func parseTreeData(data []byte) (*Tree, error) {
+// data from the tree object. hashSize is the length of the object ids.
+func parseTreeData(data []byte, hashSize int) (*Tree, error) {
 	tree := new(Tree)
 	tree.TreeEntries = make([]*TreeEntry, 0, 10)
 	l := len(data)
@@ -61,6 +61,9 @@ func parseTreeData(data []byte) (*Tree, error) {
 	for pos < l {
 		te := new(TreeEntry)
 		spacepos := bytes.IndexByte(data[pos:], ' ')
+		if spacepos < 0 {
+			return nil, errors.New("tree entry truncated")
+		}
 		switch string(data[pos : pos+spacepos]) {
 		case "100644":
 			te.Filemode = FileModeBlob
@@ -82,14 +85,20 @@ func parseTreeData(data []byte) (*Tree, error) {
 		}
 		pos += spacepos + 1
 		zero := bytes.IndexByte(data[pos:], 0)
+		if zero < 0 {
+			return nil, errors.New("tree entry truncated")
+		}
 		te.Name = string(data[pos : pos+zero])
 		pos += zero + 1
-		oid, err := NewOid(data[pos : pos+20])
+		if pos+hashSize > l {
+			return nil, errors.New("tree entry truncated")
+		}
+		oid, err := NewOid(data[pos : pos+hashSize])
 		if err != nil {
 			return nil, err
 		}
 		te.Id = oid
-		pos = pos + 20
+		pos = pos + hashSize
 		tree.TreeEntries = append(tree.TreeEntries, te)
 	}
 	return tree, nil
@@ -130,47 +139,52 @@ type TreeWalkCallback func(string, *TreeEntry) int
 // If the callback returns a positive value, the passed entry will be skipped
 // on the traversal (in pre mode). A negative value stops the walk.
 //
-// Walk will panic() if an error occurs
+// If a subtree can't be read (for example because the repository has been
+// closed), the walk stops and the error is returned.
 func (t *Tree) Walk(callback TreeWalkCallback) error {
-	t._walk(callback, "")
-	return nil
+	_, err := t._walk(callback, "")
+	return err
 }
 
-func (t *Tree) _walk(cb TreeWalkCallback, dirname string) bool {
+func (t *Tree) _walk(cb TreeWalkCallback, dirname string) (bool, error) {
 	for _, te := range t.TreeEntries {
 		cont := cb(dirname, te)
 		switch {
 		case cont < 0:
-			return false
+			return false, nil
 		case cont == 0:
 			// descend if it is a tree
 			if te.Type == ObjectTree {
 				t, err := t.repository.LookupTree(te.Id)
 				if err != nil {
-					panic(err)
+					return false, err
 				}
-				if t._walk(cb, path.Join(dirname, te.Name)) == false {
-					return false
+				if ok, err := t._walk(cb, path.Join(dirname, te.Name)); !ok || err != nil {
+					return false, err
 				}
 			}
 		case cont > 0:
 			// do nothing, don't descend into the tree
 		}
 	}
-	return true
+	return true, nil
 }
 
 // Find the tree object in the repository.
 func (repos *Repository) LookupTree(oid *Oid) (*Tree, error) {
+	if tree, ok := repos.objectCache.get(oid).(*Tree); ok {
+		return tree, nil
+	}
 	_, _, data, err := repos.getRawObject(oid)
 	if err != nil {
 		return nil, err
 	}
-	tree, err := parseTreeData(data)
+	tree, err := parseTreeData(data, repos.hash.Size())
 	if err != nil {
 		return nil, err
 	}
 	tree.Oid = oid
 	tree.repository = repos
+	repos.objectCache.add(oid, tree)
 	return tree, nil
 }
@@ -0,0 +1,227 @@
+// Copyright (c) 2013 Patrick Gundlach, speedata (Berlin, Germany)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gogit
+
+import (
+	"errors"
+	"strings"
+)
+
+// A TreeBuilder creates new trees or modifies existing ones. Entries are
+// inserted and removed by their path relative to the root tree, missing
+// subtrees are created on the way. Write stores the modified trees in the
+// repository and returns the id of the root tree.
+type TreeBuilder struct {
+	repository *Repository
+	entries    map[string]*treeBuilderEntry
+}
+
+// An entry of a TreeBuilder. Subtrees are only loaded into a TreeBuilder
+// of their own (subtree) when they are modified.
+type treeBuilderEntry struct {
+	filemode int
+	id       *Oid
+	subtree  *TreeBuilder
+}
+
+// Return a TreeBuilder for a new, empty tree.
+func (repos *Repository) TreeBuilder() (*TreeBuilder, error) {
+	if err := repos.checkOpen(); err != nil {
+		return nil, err
+	}
+	return &TreeBuilder{repository: repos, entries: make(map[string]*treeBuilderEntry)}, nil
+}
+
+// Return a TreeBuilder that starts with the entries of tree.
+func (repos *Repository) TreeBuilderFromTree(tree *Tree) (*TreeBuilder, error) {
+	tb, err := repos.TreeBuilder()
+	if err != nil {
+		return nil, err
+	}
+	for _, te := range tree.TreeEntries {
+		tb.entries[te.Name] = &treeBuilderEntry{filemode: te.Filemode, id: te.Id}
+	}
+	return tb, nil
+}
+
+// Split a path such as "dir/subdir/file" into its components.
+func splitTreePath(path string) ([]string, error) {
+	parts := strings.Split(path, "/")
+	for _, part := range parts {
+		if part == "" || part == "." || part == ".." {
+			return nil, errors.New("Invalid path: " + path)
+		}
+	}
+	return parts, nil
+}
+
+// Return the TreeBuilder for the subtree name. If create is true, a
+// missing subtree is created.
+func (tb *TreeBuilder) subtree(name string, create bool) (*TreeBuilder, error) {
+	e, ok := tb.entries[name]
+	if !ok {
+		if !create {
+			return nil, errObjNotFound
+		}
+		e = &treeBuilderEntry{filemode: FileModeTree, subtree: &TreeBuilder{repository: tb.repository, entries: make(map[string]*treeBuilderEntry)}}
+		tb.entries[name] = e
+		return e.subtree, nil
+	}
+	if e.filemode != FileModeTree {
+		return nil, errors.New("Not a tree: " + name)
+	}
+	if e.subtree == nil {
+		tree, err := tb.repository.LookupTree(e.id)
+		if err != nil {
+			return nil, err
+		}
+		if e.subtree, err = tb.repository.TreeBuilderFromTree(tree); err != nil {
+			return nil, err
+		}
+	}
+	return e.subtree, nil
+}
+
+// Return the TreeBuilder of the directory that contains the last
+// component of parts. If modify is true, missing subtrees are created and
+// the subtrees on the way are marked as modified.
+func (tb *TreeBuilder) parent(parts []string, modify bool) (*TreeBuilder, error) {
+	for _, name := range parts[:len(parts)-1] {
+		sub, err := tb.subtree(name, modify)
+		if err != nil {
+			return nil, err
+		}
+		if modify {
+			// The id changes when the tree is written
+			tb.entries[name].id = nil
+		}
+		tb = sub
+	}
+	return tb, nil
+}
+
+// Insert the object id at path with the given file mode (FileModeBlob,
+// FileModeTree, ...). An existing entry at path is replaced, missing
+// subtrees on the way are created.
+func (tb *TreeBuilder) Insert(path string, id *Oid, filemode int) error {
+	parts, err := splitTreePath(path)
+	if err != nil {
+		return err
+	}
+	if err = tb.repository.checkOidSize(id); err != nil {
+		return err
+	}
+	switch filemode {
+	case FileModeBlob, FileModeBlobExec, FileModeSymlink, FileModeCommit, FileModeTree:
+	default:
+		return errors.New("Invalid file mode for " + path)
+	}
+	dir, err := tb.parent(parts, true)
+	if err != nil {
+		return err
+	}
+	dir.entries[parts[len(parts)-1]] = &treeBuilderEntry{filemode: filemode, id: id}
+	return nil
+}
+
+// Remove the entry at path. Subtrees that become empty are removed when
+// the tree is written.
+func (tb *TreeBuilder) Remove(path string) error {
+	parts, err := splitTreePath(path)
+	if err != nil {
+		return err
+	}
+	dir, err := tb.parent(parts, false)
+	if err == errObjNotFound || err == nil && dir.entries[parts[len(parts)-1]] == nil {
+		return errors.New("No such tree entry: " + path)
+	}
+	if err != nil {
+		return err
+	}
+	if dir, err = tb.parent(parts, true); err != nil {
+		return err
+	}
+	delete(dir.entries, parts[len(parts)-1])
+	return nil
+}
+
+// Return the entry at path or nil if there is no such entry. The id of a
+// modified subtree is only known after Write and is nil before.
+func (tb *TreeBuilder) EntryByPath(path string) *TreeEntry {
+	parts, err := splitTreePath(path)
+	if err != nil {
+		return nil
+	}
+	dir, err := tb.parent(parts, false)
+	if err != nil {
+		return nil
+	}
+	name := parts[len(parts)-1]
+	e, ok := dir.entries[name]
+	if !ok {
+		return nil
+	}
+	return newTreeEntry(name, e.filemode, e.id)
+}
+
+// Return a tree entry with the type derived from the file mode.
+func newTreeEntry(name string, filemode int, id *Oid) *TreeEntry {
+	te := &TreeEntry{Filemode: filemode, Name: name, Id: id, Type: ObjectBlob}
+	switch filemode {
+	case FileModeTree:
+		te.Type = ObjectTree
+	case FileModeCommit:
+		te.Type = ObjectCommit
+	}
+	return te
+}
+
+// Write the tree and all modified subtrees to the repository and return
+// the id of the tree. Empty subtrees are left out, git doesn't store
+// them.
+func (tb *TreeBuilder) Write() (*Oid, error) {
+	id, _, err := tb.write(true)
+	return id, err
+}
+
+// Write the tree, return its id and the number of entries. An empty tree
+// is only written if root is true.
+func (tb *TreeBuilder) write(root bool) (*Oid, int, error) {
+	entries := make([]*TreeEntry, 0, len(tb.entries))
+	for name, e := range tb.entries {
+		if e.subtree != nil && e.id == nil {
+			id, n, err := e.subtree.write(false)
+			if err != nil {
+				return nil, 0, err
+			}
+			if n == 0 {
+				continue
+			}
+			e.id = id
+		}
+		entries = append(entries, newTreeEntry(name, e.filemode, e.id))
+	}
+	if len(entries) == 0 && !root {
+		return nil, 0, nil
+	}
+	id, err := tb.repository.WriteTree(entries)
+	return id, len(entries), err
+}
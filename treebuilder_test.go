@@ -0,0 +1,124 @@
+package gogit
+
+import (
+	"os"
+	"testing"
+)
+
+func TestTreeBuilder(t *testing.T) {
+	dir := copyRepository(t, "_testdata/testrepo.git")
+	defer os.RemoveAll(dir)
+	repos, err := OpenRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repos.Close()
+
+	tree, err := repos.LookupTree(mustOidFromString(t, "7cc610f7268f024d3684a3778ff5aac89c2515bc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb, err := repos.TreeBuilderFromTree(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An unmodified tree is written with the same id
+	oid, err := tb.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !oid.Equal(tree.Oid) {
+		t.Errorf("unmodified tree written as %s", oid)
+	}
+
+	blob := mustOidFromString(t, "5c41408e01a1cb93ff684882e10dfa418bf0d043")
+	exec := mustOidFromString(t, "741168da30db6d3590cb2abd63570f4cd1ed3b87")
+	if err = tb.Insert("dira/subdirb/new.txt", blob, FileModeBlob); err != nil {
+		t.Fatal(err)
+	}
+	if err = tb.Remove("dirb/file1.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err = tb.Insert("file1.txt", exec, FileModeBlobExec); err != nil {
+		t.Fatal(err)
+	}
+	if err = tb.Insert("newdir/deep/x.txt", blob, FileModeBlob); err != nil {
+		t.Fatal(err)
+	}
+	if te := tb.EntryByPath("dira/subdirb/new.txt"); te == nil || !te.Id.Equal(blob) {
+		t.Error("inserted entry not found")
+	}
+	if te := tb.EntryByPath("dira/subdira/file1.txt"); te == nil || te.Id.String() != "8c45f3a09937f41b60701bdad5eb46b54086485d" {
+		t.Error("existing entry not found")
+	}
+	if te := tb.EntryByPath("dirb/file1.txt"); te != nil {
+		t.Error("removed entry found")
+	}
+	// Results from git update-index and git write-tree
+	if oid, err = tb.Write(); err != nil {
+		t.Fatal(err)
+	}
+	if oid.String() != "3ebb8b5ea39cda74e10d536ed6bdc72d60c86b65" {
+		t.Errorf("modified tree written as %s", oid)
+	}
+	if te := tb.EntryByPath("newdir"); te == nil || te.Id.String() != "77363779bf5ffe6191fc6c647f08d624bf526d31" {
+		t.Error("wrong id for new subtree")
+	}
+	// A tree sorts as if its name had a trailing slash: "dira.txt" < "dira/"
+	if err = tb.Insert("dira.txt", blob, FileModeBlob); err != nil {
+		t.Fatal(err)
+	}
+	if oid, err = tb.Write(); err != nil {
+		t.Fatal(err)
+	}
+	if oid.String() != "5ecc6bdec10f535b69f615098e806e3f1e709bc1" {
+		t.Errorf("tree written as %s", oid)
+	}
+	written, err := repos.LookupTree(oid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written.EntryByIndex(0).Name != "dira.txt" || written.EntryByIndex(1).Name != "dira" {
+		t.Error("entries not in canonical order")
+	}
+
+	for _, path := range []string{"doesnotexist", "dira/nothere", "file2.txt/x", "nodir/x"} {
+		if err = tb.Remove(path); err == nil {
+			t.Errorf("remove %s: expected error", path)
+		}
+	}
+	for _, path := range []string{"", "/a", "a//b", "a/../b", "file2.txt/x"} {
+		if err = tb.Insert(path, blob, FileModeBlob); err == nil {
+			t.Errorf("insert %q: expected error", path)
+		}
+	}
+}
+
+func TestTreeBuilderEmpty(t *testing.T) {
+	dir := copyRepository(t, "_testdata/testrepo.git")
+	defer os.RemoveAll(dir)
+	repos, err := OpenRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repos.Close()
+	tb, err := repos.TreeBuilder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := mustOidFromString(t, "5c41408e01a1cb93ff684882e10dfa418bf0d043")
+	if err = tb.Insert("a/b/c", blob, FileModeBlob); err != nil {
+		t.Fatal(err)
+	}
+	if err = tb.Remove("a/b/c"); err != nil {
+		t.Fatal(err)
+	}
+	// The empty subtrees a and a/b are left out
+	oid, err := tb.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oid.String() != "4b825dc642cb6eb9a060e54bf8d69288fbee4904" {
+		t.Errorf("empty tree written as %s", oid)
+	}
+}
@@ -0,0 +1,439 @@
+// Copyright (c) 2013 Patrick Gundlach, speedata (Berlin, Germany)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gogit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// The kind of a problem found by Verify.
+type VerifyProblemKind int
+
+const (
+	// The checksum at the end of a pack or idx file doesn't match its
+	// contents.
+	VerifyPackChecksum VerifyProblemKind = iota
+	// The CRC32 of a packed object doesn't match the one in the idx file.
+	VerifyCRC
+	// The contents of an object don't hash to its id.
+	VerifyHash
+	// An object can't be read (corrupt compressed data, bad delta, ...)
+	// or an idx file or the multi-pack-index can't be read.
+	VerifyUnreadable
+	// A commit, tree or tag object is malformed.
+	VerifySyntax
+	// An object has a different type than the object referring to it
+	// expects.
+	VerifyWrongType
+	// An object reachable from a reference is missing.
+	VerifyMissing
+)
+
+func (k VerifyProblemKind) String() string {
+	switch k {
+	case VerifyPackChecksum:
+		return "pack checksum"
+	case VerifyCRC:
+		return "crc"
+	case VerifyHash:
+		return "hash"
+	case VerifyUnreadable:
+		return "unreadable"
+	case VerifySyntax:
+		return "syntax"
+	case VerifyWrongType:
+		return "wrong type"
+	case VerifyMissing:
+		return "missing"
+	default:
+		return ""
+	}
+}
+
+// A problem found by Verify.
+type VerifyProblem struct {
+	Kind VerifyProblemKind
+	// The object, nil for problems of a whole pack or idx file
+	Oid *Oid
+	// The pack, idx or loose object file, empty for missing objects
+	Path    string
+	Message string
+}
+
+func (p VerifyProblem) String() string {
+	s := p.Kind.String()
+	if p.Oid != nil {
+		s += " " + p.Oid.String()
+	}
+	if p.Path != "" {
+		s += " (" + p.Path + ")"
+	}
+	return s + ": " + p.Message
+}
+
+// The result of Verify.
+type VerifyResult struct {
+	// The number of objects read. An object stored more than once is
+	// counted more than once.
+	Objects int
+	// The number of objects reachable from the references
+	Reachable int
+	Problems  []VerifyProblem
+}
+
+// Return true if no problems have been found.
+func (r *VerifyResult) OK() bool {
+	return len(r.Problems) == 0
+}
+
+type verifier struct {
+	repos  *Repository
+	result *VerifyResult
+}
+
+func (v *verifier) report(kind VerifyProblemKind, oid *Oid, path, format string, a ...interface{}) {
+	v.result.Problems = append(v.result.Problems, VerifyProblem{Kind: kind, Oid: oid, Path: path, Message: fmt.Sprintf(format, a...)})
+}
+
+// Check the integrity of the repository, similar to git fsck: the
+// checksums of the pack and idx files, idx files and a multi-pack-index
+// that can't be read (they are skipped when looking up objects), the CRC32 of the packed objects
+// (version 2 idx files only), the ids of all loose and packed objects, the
+// syntax of commits, trees and tags, and that every object reachable from
+// HEAD and the references exists and has the expected type. Objects in
+// alternate object directories are checked as well.
+//
+// All problems found are reported in the result. The error is only set
+// if the check itself fails, for example because the repository has been
+// closed.
+func (repos *Repository) Verify() (*VerifyResult, error) {
+	v := &verifier{repos: repos, result: new(VerifyResult)}
+	if err := repos.rlock(); err != nil {
+		return nil, err
+	}
+	var dirs []string
+	var packs []*idxFile
+	for _, store := range repos.stores {
+		dirs = append(dirs, store.dir)
+		for _, idx := range store.indexfiles {
+			if idx.acquire() {
+				packs = append(packs, idx)
+			}
+		}
+		badPacks := make([]string, 0, len(store.badPacks))
+		for path := range store.badPacks {
+			badPacks = append(badPacks, path)
+		}
+		sort.Strings(badPacks)
+		for _, path := range badPacks {
+			v.report(VerifyUnreadable, nil, path, "%s", store.badPacks[path])
+		}
+		if store.midxErr != nil {
+			v.report(VerifyUnreadable, nil, filepath.Join(store.dir, "pack", "multi-pack-index"), "%s", store.midxErr)
+		}
+	}
+	repos.mu.RUnlock()
+	defer func() {
+		for _, idx := range packs {
+			idx.release()
+		}
+	}()
+
+	for _, dir := range dirs {
+		if err := v.verifyLooseObjects(dir); err != nil {
+			return nil, err
+		}
+	}
+	for _, idx := range packs {
+		if err := v.verifyPack(idx); err != nil {
+			return nil, err
+		}
+	}
+	if err := v.verifyConnectivity(); err != nil {
+		return nil, err
+	}
+	return v.result, nil
+}
+
+// Check all loose objects in the object directory dir.
+func (v *verifier) verifyLooseObjects(dir string) error {
+	subdirs, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, subdir := range subdirs {
+		if !subdir.IsDir() || len(subdir.Name()) != 2 {
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(dir, subdir.Name()))
+		if err != nil {
+			return err
+		}
+		for _, fi := range files {
+			sha, err := hex.DecodeString(subdir.Name() + fi.Name())
+			if err != nil || len(sha) != v.repos.hash.Size() {
+				continue
+			}
+			path := filepath.Join(dir, subdir.Name(), fi.Name())
+			ot, _, data, err := v.repos.readObjectFile(path, false)
+			if os.IsNotExist(err) {
+				// removed in the meantime
+				continue
+			}
+			v.verifyObject(&Oid{Bytes: sha}, path, ot, data, err)
+		}
+	}
+	return nil
+}
+
+// Check the pack file belonging to idx and all objects in it.
+func (v *verifier) verifyPack(idx *idxFile) error {
+	if err := idx.checkChecksum(v.repos.hash); err != nil {
+		v.report(VerifyPackChecksum, nil, idx.path, "idx checksum mismatch")
+	}
+	pack := idx.packMmap
+	hashSize := idx.hashSize
+	h := v.repos.hash.New()
+	h.Write(pack[:len(pack)-hashSize])
+	if !bytes.Equal(h.Sum(nil), pack[len(pack)-hashSize:]) {
+		v.report(VerifyPackChecksum, nil, idx.packpath, "pack checksum mismatch")
+	}
+
+	// The packed data of an object ends where the next object starts,
+	// so sort the objects by offset to check the CRC32.
+	type packedObject struct {
+		n      int64
+		offset uint64
+	}
+	count := int64(len(idx.shaTable) / hashSize)
+	objects := make([]packedObject, count)
+	for n := int64(0); n < count; n++ {
+		objects[n] = packedObject{n, idx.offsetAt(n)}
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].offset < objects[j].offset
+	})
+	end := uint64(len(pack) - hashSize)
+	for i, obj := range objects {
+		sha := idx.shaTable[obj.n*int64(hashSize) : (obj.n+1)*int64(hashSize)]
+		oid := &Oid{Bytes: append([]byte(nil), sha...)}
+		next := end
+		if i+1 < len(objects) {
+			next = objects[i+1].offset
+		}
+		if obj.offset < 12 || obj.offset >= next || next > end {
+			v.report(VerifyUnreadable, oid, idx.packpath, "invalid offset %d in pack index", obj.offset)
+			continue
+		}
+		if idx.crcTable != nil {
+			crc := binary.BigEndian.Uint32(idx.crcTable[obj.n*4 : obj.n*4+4])
+			if crc32.ChecksumIEEE(pack[obj.offset:next]) != crc {
+				v.report(VerifyCRC, oid, idx.packpath, "crc32 mismatch at offset %d", obj.offset)
+			}
+		}
+		// Deltas with a base in another pack or a loose base need the
+		// object stores, so read with the repository lock held.
+		if err := v.repos.rlock(); err != nil {
+			return err
+		}
+		ot, _, data, err := v.repos.readObjectBytes(idx, obj.offset, false)
+		v.repos.mu.RUnlock()
+		v.verifyObject(oid, idx.packpath, ot, data, err)
+	}
+	return nil
+}
+
+// Check a single object that has been read from path: readErr is the
+// error from reading it, otherwise its id and syntax are checked.
+func (v *verifier) verifyObject(oid *Oid, path string, ot ObjectType, data []byte, readErr error) {
+	v.result.Objects++
+	if readErr != nil {
+		v.report(VerifyUnreadable, oid, path, "%s", readErr)
+		return
+	}
+	if sum := hashObject(v.repos.hash, ot, data); !sum.Equal(oid) {
+		v.report(VerifyHash, oid, path, "contents hash to %s", sum)
+		return
+	}
+	if err := v.checkSyntax(ot, data); err != nil {
+		v.report(VerifySyntax, oid, path, "%s", err)
+	}
+}
+
+// Return an error if the commit, tree or tag data is malformed.
+func (v *verifier) checkSyntax(ot ObjectType, data []byte) error {
+	switch ot {
+	case ObjectCommit:
+		ci, err := parseCommitData(data)
+		if err != nil {
+			return err
+		}
+		switch {
+		case ci.treeId == nil:
+			return fmt.Errorf("commit has no tree")
+		case ci.Author == nil:
+			return fmt.Errorf("commit has no author")
+		case ci.Committer == nil:
+			return fmt.Errorf("commit has no committer")
+		}
+		return v.checkOidSizes(append([]*Oid{ci.treeId}, ci.parents...))
+	case ObjectTree:
+		tree, err := parseTreeData(data, v.repos.hash.Size())
+		if err != nil {
+			return err
+		}
+		// Entries with the same name need not be adjacent, see encodeTree
+		names := make(map[string]bool, len(tree.TreeEntries))
+		for _, te := range tree.TreeEntries {
+			if names[te.Name] {
+				return fmt.Errorf("duplicate tree entry %q", te.Name)
+			}
+			names[te.Name] = true
+		}
+		return nil
+	case ObjectTag:
+		tag, err := parseTagData(data)
+		if err != nil {
+			return err
+		}
+		return v.checkOidSizes([]*Oid{tag.TargetId})
+	}
+	return nil
+}
+
+// Return an error if an object id doesn't match the hash algorithm of the
+// repository.
+func (v *verifier) checkOidSizes(oids []*Oid) error {
+	for _, oid := range oids {
+		if len(oid.Bytes) != v.repos.hash.Size() {
+			return fmt.Errorf("object id %s has the wrong length", oid)
+		}
+	}
+	return nil
+}
+
+// Walk all objects reachable from HEAD and the references and report the
+// ones that are missing or have the wrong type. Objects that exist but
+// can't be read have already been reported and are not followed.
+func (v *verifier) verifyConnectivity() error {
+	type item struct {
+		oid  *Oid
+		ot   ObjectType // expected type, 0 if any type is fine
+		from string     // the reference or object id referring to oid
+	}
+	var todo []item
+	refs, err := v.repos.readReferences()
+	if err != nil {
+		return err
+	}
+	// HEAD is not below refs/ and might be detached. A symbolic HEAD to a
+	// branch that doesn't exist yet (in an empty repository) is not a
+	// problem.
+	head, err := v.repos.LookupReference("HEAD")
+	if err == ErrClosed {
+		return err
+	}
+	if err == nil {
+		refs = append(refs, &Reference{Name: "HEAD", Oid: head.Oid})
+	}
+	for _, ref := range refs {
+		todo = append(todo, item{ref.Oid, 0, ref.Name})
+	}
+
+	seen := make(map[string]bool)
+	for len(todo) > 0 {
+		it := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+		if seen[it.oid.key()] {
+			continue
+		}
+		seen[it.oid.key()] = true
+		ot, _, err := v.repos.Header(it.oid)
+		if err == errObjNotFound {
+			v.report(VerifyMissing, it.oid, "", "referenced by %s", it.from)
+			continue
+		}
+		if err == ErrClosed {
+			return err
+		}
+		if err != nil {
+			continue
+		}
+		v.result.Reachable++
+		if it.ot != 0 && ot != it.ot {
+			v.report(VerifyWrongType, it.oid, "", "%s expected, %s referenced by %s", it.ot, ot, it.from)
+			continue
+		}
+		if ot == ObjectBlob {
+			continue
+		}
+		_, _, data, err := v.repos.getRawObject(it.oid)
+		if err == ErrClosed {
+			return err
+		}
+		if err != nil {
+			continue
+		}
+		from := it.oid.String()
+		switch ot {
+		case ObjectCommit:
+			ci, err := parseCommitData(data)
+			if err != nil {
+				continue
+			}
+			if ci.treeId != nil {
+				todo = append(todo, item{ci.treeId, ObjectTree, from})
+			}
+			for _, parent := range ci.parents {
+				todo = append(todo, item{parent, ObjectCommit, from})
+			}
+		case ObjectTree:
+			tree, err := parseTreeData(data, v.repos.hash.Size())
+			if err != nil {
+				continue
+			}
+			for _, te := range tree.TreeEntries {
+				// Submodule commits are in another repository.
+				if te.Filemode != FileModeCommit {
+					todo = append(todo, item{te.Id, te.Type, from})
+				}
+			}
+		case ObjectTag:
+			tag, err := parseTagData(data)
+			if err != nil {
+				continue
+			}
+			todo = append(todo, item{tag.TargetId, tag.Type.objectType(), from})
+		}
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package gogit
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func hasProblem(res *VerifyResult, kind VerifyProblemKind, oid string) bool {
+	for _, p := range res.Problems {
+		if p.Kind == kind && (oid == "" || p.Oid != nil && p.Oid.String() == oid) {
+			return true
+		}
+	}
+	return false
+}
+
+func verifyRepository(t *testing.T, path string) *VerifyResult {
+	repos, err := OpenRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repos.Close()
+	res, err := repos.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// Write data as a loose object of type ot into the repository at dir
+// without any checks and return its id.
+func writeLooseObject(t *testing.T, dir string, ot ObjectType, data []byte) *Oid {
+	oid := hashObject(HashSHA1, ot, data)
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write([]byte(ot.headerName() + " " + strconv.Itoa(len(data)) + "\x00"))
+	zw.Write(data)
+	zw.Close()
+	path := filepathFromSHA1(filepath.Join(dir, "objects"), oid.String())
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0444); err != nil {
+		t.Fatal(err)
+	}
+	return oid
+}
+
+func TestVerify(t *testing.T) {
+	testdata := []struct {
+		name      string
+		objects   int
+		reachable int
+	}{
+		{"testrepo.git", 58, 58},
+		{"idxv1.git", 50, 50},
+		{"refdelta.git", 24, 24},
+		{"midx.git", 24, 24},
+		{"alternates.git", 61, 61},
+		{"sha256.git", 19, 19},
+	}
+	for _, td := range testdata {
+		res := verifyRepository(t, filepath.Join("_testdata", td.name))
+		if !res.OK() {
+			t.Errorf("%s: unexpected problems %v", td.name, res.Problems)
+		}
+		if res.Objects != td.objects || res.Reachable != td.reachable {
+			t.Errorf("%s: got %d objects, %d reachable, want %d, %d", td.name, res.Objects, res.Reachable, td.objects, td.reachable)
+		}
+	}
+}
+
+func TestVerifyLooseObjects(t *testing.T) {
+	dir := copyRepository(t, "_testdata/testrepo.git")
+	defer os.RemoveAll(dir)
+	objects := filepath.Join(dir, "objects")
+
+	// Store the contents of another blob under the id of dirc/file2.txt
+	data, err := ioutil.ReadFile(filepath.Join(objects, "74", "1168da30db6d3590cb2abd63570f4cd1ed3b87"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(objects, "5c", "41408e01a1cb93ff684882e10dfa418bf0d043"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// and remove the blob execfile1
+	if err = os.Remove(filepath.Join(objects, "74", "1168da30db6d3590cb2abd63570f4cd1ed3b87")); err != nil {
+		t.Fatal(err)
+	}
+
+	res := verifyRepository(t, dir)
+	if len(res.Problems) != 2 {
+		t.Errorf("got %d problems, want 2: %v", len(res.Problems), res.Problems)
+	}
+	if !hasProblem(res, VerifyHash, "5c41408e01a1cb93ff684882e10dfa418bf0d043") {
+		t.Error("hash mismatch not reported")
+	}
+	if !hasProblem(res, VerifyMissing, "741168da30db6d3590cb2abd63570f4cd1ed3b87") {
+		t.Error("missing object not reported")
+	}
+}
+
+func TestVerifySyntax(t *testing.T) {
+	dir := copyRepository(t, "_testdata/testrepo.git")
+	defer os.RemoveAll(dir)
+
+	// A commit without author and committer, referenced by a branch
+	oid := writeLooseObject(t, dir, ObjectCommit, []byte("tree 7cc610f7268f024d3684a3778ff5aac89c2515bc\n\nNo author\n"))
+	if err := ioutil.WriteFile(filepath.Join(dir, "refs", "heads", "broken"), []byte(oid.String()+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// A tree with two entries "a", which are not adjacent: "a", "a-b", "a/"
+	blobId := mustOidFromString(t, "5c41408e01a1cb93ff684882e10dfa418bf0d043")
+	treeId := mustOidFromString(t, "d748a00ed9d90fe29748453ce3a1b5f039332f3d")
+	data := append([]byte("100644 a\x00"), blobId.Bytes...)
+	data = append(append(data, "100644 a-b\x00"...), blobId.Bytes...)
+	data = append(append(data, "40000 a\x00"...), treeId.Bytes...)
+	dup := writeLooseObject(t, dir, ObjectTree, data)
+
+	res := verifyRepository(t, dir)
+	if len(res.Problems) != 2 || !hasProblem(res, VerifySyntax, oid.String()) || !hasProblem(res, VerifySyntax, dup.String()) {
+		t.Errorf("expected syntax problems for %s and %s, got %v", oid, dup, res.Problems)
+	}
+}
+
+func TestVerifyPack(t *testing.T) {
+	dir := copyRepository(t, "_testdata/testrepo.git")
+	defer os.RemoveAll(dir)
+	packpath := filepath.Join(dir, "objects", "pack", "pack-efa084d62d89521059a514772fd2966a3a230984.pack")
+	data, err := ioutil.ReadFile(packpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 0xff
+	if err = ioutil.WriteFile(packpath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	res := verifyRepository(t, dir)
+	if !hasProblem(res, VerifyPackChecksum, "") {
+		t.Error("pack checksum mismatch not reported")
+	}
+	if !hasProblem(res, VerifyCRC, "") {
+		t.Error("crc mismatch not reported")
+	}
+	for _, p := range res.Problems {
+		if p.Kind != VerifyPackChecksum && p.Path != packpath {
+			t.Errorf("unexpected problem %v", p)
+		}
+	}
+}
+
+func TestVerifyClosed(t *testing.T) {
+	repos, err := OpenRepository("_testdata/testrepo.git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repos.Close()
+	if _, err = repos.Verify(); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright (c) 2013 Patrick Gundlach, speedata (Berlin, Germany)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gogit
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Write the data as a blob object to the repository and return its id.
+func (repos *Repository) WriteBlob(data []byte) (*Oid, error) {
+	return repos.writeObject(ObjectBlob, data)
+}
+
+// Write a tree object with the given entries to the repository and return
+// its id. Only Filemode, Name and Id of the entries are used. The entries
+// are written in the order git requires, so they need not be sorted.
+func (repos *Repository) WriteTree(entries []*TreeEntry) (*Oid, error) {
+	data, err := repos.encodeTree(entries)
+	if err != nil {
+		return nil, err
+	}
+	return repos.writeObject(ObjectTree, data)
+}
+
+// Write a commit object to the repository and return its id. The message
+// is written as is, git usually ends it with a newline.
+func (repos *Repository) WriteCommit(treeId *Oid, parents []*Oid, author, committer *Signature, message string) (*Oid, error) {
+	if err := repos.checkOidSize(treeId); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteString("tree " + treeId.String() + "\n")
+	for _, parent := range parents {
+		if err := repos.checkOidSize(parent); err != nil {
+			return nil, err
+		}
+		buf.WriteString("parent " + parent.String() + "\n")
+	}
+	for _, sig := range []*Signature{author, committer} {
+		if err := sig.validate(); err != nil {
+			return nil, err
+		}
+	}
+	buf.WriteString("author " + author.commitline() + "\n")
+	buf.WriteString("committer " + committer.commitline() + "\n")
+	buf.WriteString("\n")
+	buf.WriteString(message)
+	return repos.writeObject(ObjectCommit, buf.Bytes())
+}
+
+// Write an annotated tag object to the repository and return its id. The
+// tag type is the type of the target object. The tag object is not
+// referenced by anything, the reference refs/tags/<name> has to be created
+// separately.
+func (repos *Repository) WriteTag(targetId *Oid, tagType TagType, name string, tagger *Signature, message string) (*Oid, error) {
+	if err := repos.checkOidSize(targetId); err != nil {
+		return nil, err
+	}
+	if name == "" || strings.ContainsAny(name, "\n") {
+		return nil, errors.New("Invalid tag name: " + strconv.Quote(name))
+	}
+	if err := tagger.validate(); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteString("object " + targetId.String() + "\n")
+	buf.WriteString("type " + tagType.objectType().headerName() + "\n")
+	buf.WriteString("tag " + name + "\n")
+	buf.WriteString("tagger " + tagger.commitline() + "\n")
+	buf.WriteString("\n")
+	buf.WriteString(message)
+	return repos.writeObject(ObjectTag, buf.Bytes())
+}
+
+// Return an error if oid is nil or doesn't match the hash algorithm of
+// the repository.
+func (repos *Repository) checkOidSize(oid *Oid) error {
+	if oid == nil || len(oid.Bytes) != repos.hash.Size() {
+		return errors.New("Invalid object id for a " + repos.hash.String() + " repository")
+	}
+	return nil
+}
+
+// Return the contents of a tree object with the given entries. Git sorts
+// the entries by name, where the name of a subtree is compared as if it
+// had a trailing slash.
+func (repos *Repository) encodeTree(entries []*TreeEntry) ([]byte, error) {
+	sortName := func(te *TreeEntry) string {
+		if te.Filemode == FileModeTree {
+			return te.Name + "/"
+		}
+		return te.Name
+	}
+	// Entries with the same name are not necessarily adjacent after
+	// sorting: "a" (blob), "a-b", "a" (tree) sorts to "a", "a-b", "a/".
+	names := make(map[string]bool, len(entries))
+	for _, te := range entries {
+		if names[te.Name] {
+			return nil, errors.New("Duplicate tree entry: " + te.Name)
+		}
+		names[te.Name] = true
+	}
+	sorted := make([]*TreeEntry, len(entries))
+	copy(sorted, entries)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sortName(sorted[i]) < sortName(sorted[j])
+	})
+	var buf bytes.Buffer
+	for _, te := range sorted {
+		if te.Name == "" || te.Name == "." || te.Name == ".." || strings.ContainsAny(te.Name, "/\x00") {
+			return nil, errors.New("Invalid tree entry name: " + strconv.Quote(te.Name))
+		}
+		switch te.Filemode {
+		case FileModeBlob, FileModeBlobExec, FileModeSymlink, FileModeCommit, FileModeTree:
+		default:
+			return nil, errors.New("Invalid file mode for tree entry " + te.Name + ": " + strconv.FormatInt(int64(te.Filemode), 8))
+		}
+		if err := repos.checkOidSize(te.Id); err != nil {
+			return nil, err
+		}
+		buf.WriteString(strconv.FormatInt(int64(te.Filemode), 8) + " " + te.Name + "\x00")
+		buf.Write(te.Id.Bytes)
+	}
+	return buf.Bytes(), nil
+}
+
+// Write an object as a loose object file and return its id. Nothing is
+// written if the object already exists, loose or packed. The file is
+// written to a temporary file first and then renamed, so other readers
+// never see a partially written object.
+func (repos *Repository) writeObject(ot ObjectType, data []byte) (*Oid, error) {
+	oid := hashObject(repos.hash, ot, data)
+	exists, err := repos.HasObject(oid)
+	if err != nil || exists {
+		return oid, err
+	}
+
+	objectsdir := filepath.Join(repos.Path, "objects")
+	path := filepathFromSHA1(objectsdir, oid.String())
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "tmp_obj_")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	z := zlib.NewWriter(tmp)
+	if _, err = z.Write([]byte(ot.headerName() + " " + strconv.Itoa(len(data)) + "\x00")); err != nil {
+		return nil, err
+	}
+	if _, err = z.Write(data); err != nil {
+		return nil, err
+	}
+	if err = z.Close(); err != nil {
+		return nil, err
+	}
+	if err = tmp.Chmod(0444); err != nil {
+		return nil, err
+	}
+	if err = tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return nil, err
+	}
+	return oid, nil
+}
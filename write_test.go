@@ -0,0 +1,173 @@
+package gogit
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWriteObjects(t *testing.T) {
+	dir := copyRepository(t, "_testdata/testrepo.git")
+	defer os.RemoveAll(dir)
+	repos, err := OpenRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repos.Close()
+
+	blobId, err := repos.WriteBlob([]byte("hello world\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blobId.String() != "3b18e512dba79e4c8300dd08aeb37f8e728b8dad" {
+		t.Errorf("blob id %s", blobId)
+	}
+	blob, err := repos.LookupBlob(blobId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(blob.Contents()) != "hello world\n" {
+		t.Errorf("blob contents %q", blob.Contents())
+	}
+	path := filepathFromSHA1(dir+"/objects", blobId.String())
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Writing the object again doesn't touch the file
+	old := time.Unix(0, 0)
+	if err = os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = repos.WriteBlob([]byte("hello world\n")); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err = os.Stat(path); err != nil || !fi.ModTime().Equal(old) {
+		t.Errorf("object file rewritten: %v", err)
+	}
+
+	sig := &Signature{Name: "Patrick Gundlach", Email: "gundlach@speedata.de", When: time.Unix(1378823654, 0).In(time.FixedZone("", 2*3600))}
+	treeId, err := repos.WriteTree([]*TreeEntry{
+		{Filemode: FileModeBlob, Name: "hello.txt", Id: blobId},
+		{Filemode: FileModeTree, Name: "dirc", Id: mustOidFromString(t, "d748a00ed9d90fe29748453ce3a1b5f039332f3d")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent := mustOidFromString(t, "1337a1a1b0694887722f8bd0e541bd0f6567a471")
+	commitId, err := repos.WriteCommit(treeId, []*Oid{parent}, sig, sig, "Synthetic commit\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := repos.LookupCommit(commitId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !commit.TreeId().Equal(treeId) || !commit.ParentId(0).Equal(parent) || commit.Message() != "Synthetic commit\n" {
+		t.Error("commit not written correctly")
+	}
+	if commit.Tree.EntryCount() != 2 || commit.Tree.EntryByIndex(0).Name != "dirc" {
+		t.Error("tree entries not sorted")
+	}
+	if !commit.Author.When.Equal(sig.When) {
+		t.Errorf("author time %s, want %s", commit.Author.When, sig.When)
+	}
+
+	tagId, err := repos.WriteTag(commitId, TagCommit, "v1", sig, "Version 1\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag, err := repos.LookupTag(tagId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tag.TargetId.Equal(commitId) || tag.Name != "v1" || tag.Message != "Version 1\n" {
+		t.Error("tag not written correctly")
+	}
+
+	res, err := repos.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.OK() {
+		t.Error(res.Problems)
+	}
+}
+
+// Objects written from their parsed contents must get the same id.
+func TestWriteObjectsRoundTrip(t *testing.T) {
+	dir := copyRepository(t, "_testdata/testrepo.git")
+	defer os.RemoveAll(dir)
+	repos, err := OpenRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repos.Close()
+
+	commit, err := repos.LookupCommit(mustOidFromString(t, "1337a1a1b0694887722f8bd0e541bd0f6567a471"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oid, err := repos.WriteCommit(commit.TreeId(), commit.parents, commit.Author, commit.Committer, commit.Message())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !oid.Equal(commit.Id()) {
+		t.Errorf("commit written as %s, want %s", oid, commit.Id())
+	}
+
+	tree, err := repos.LookupTree(mustOidFromString(t, "7cc610f7268f024d3684a3778ff5aac89c2515bc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oid, err = repos.WriteTree(tree.TreeEntries); err != nil {
+		t.Fatal(err)
+	}
+	if !oid.Equal(tree.Oid) {
+		t.Errorf("tree written as %s, want %s", oid, tree.Oid)
+	}
+
+	tagId := mustOidFromString(t, "e6f8d0db36fd0e048979d115478abec90682bd78")
+	tag, err := repos.LookupTag(tagId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oid, err = repos.WriteTag(tag.TargetId, tag.Type, tag.Name, tag.Tagger, tag.Message); err != nil {
+		t.Fatal(err)
+	}
+	if !oid.Equal(tagId) {
+		t.Errorf("tag written as %s, want %s", oid, tagId)
+	}
+}
+
+func TestWriteInvalid(t *testing.T) {
+	dir := copyRepository(t, "_testdata/testrepo.git")
+	defer os.RemoveAll(dir)
+	repos, err := OpenRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobId := mustOidFromString(t, "5c41408e01a1cb93ff684882e10dfa418bf0d043")
+	invalid := [][]*TreeEntry{
+		{{Filemode: FileModeBlob, Name: "a/b", Id: blobId}},
+		{{Filemode: FileModeBlob, Name: "", Id: blobId}},
+		{{Filemode: 0100600, Name: "a", Id: blobId}},
+		{{Filemode: FileModeBlob, Name: "a"}},
+		{{Filemode: FileModeBlob, Name: "a", Id: blobId}, {Filemode: FileModeBlobExec, Name: "a", Id: blobId}},
+		// not adjacent after sorting: "a", "a-b", "a/"
+		{{Filemode: FileModeBlob, Name: "a", Id: blobId}, {Filemode: FileModeBlob, Name: "a-b", Id: blobId}, {Filemode: FileModeTree, Name: "a", Id: mustOidFromString(t, "d748a00ed9d90fe29748453ce3a1b5f039332f3d")}},
+	}
+	for i, entries := range invalid {
+		if _, err := repos.WriteTree(entries); err == nil {
+			t.Errorf("tree %d: expected error", i)
+		}
+	}
+	sig := &Signature{Name: "A <B>", Email: "a@example.com"}
+	if _, err := repos.WriteCommit(blobId, nil, sig, sig, ""); err == nil {
+		t.Error("expected error for invalid signature")
+	}
+	repos.Close()
+	if _, err := repos.WriteBlob([]byte("x")); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+}